@@ -0,0 +1,164 @@
+package goshadertranslator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// defaultMaxResponseSize bounds how far a module response is scanned for
+// its null terminator when no WithMaxResponseSize option is given.
+const defaultMaxResponseSize = 4 << 20
+
+// defaultModuleName is the wazero module name used when no WithModuleName
+// option is given.
+const defaultModuleName = "angle"
+
+// Engine selects how wazero executes the ANGLE module.
+type Engine int
+
+const (
+	// EngineAuto uses the optimizing compiler where wazero supports it and
+	// falls back to the interpreter elsewhere.
+	EngineAuto Engine = iota
+	// EngineCompiler compiles the module to native code. Compiling is slow
+	// the first time per process, but translations run much faster.
+	EngineCompiler
+	// EngineInterpreter interprets the module. It starts quickly and runs on
+	// every platform Go supports, but translations are considerably slower.
+	EngineInterpreter
+)
+
+// String returns "auto", "compiler" or "interpreter".
+func (e Engine) String() string {
+	switch e {
+	case EngineAuto:
+		return "auto"
+	case EngineCompiler:
+		return "compiler"
+	case EngineInterpreter:
+		return "interpreter"
+	}
+	return fmt.Sprintf("Engine(%d)", int(e))
+}
+
+// Observer is called after each stage of a translation with the stage and
+// the time it took, for attributing latency. Stages are reported in the
+// order StageWrite, StageInvoke, StageRead, StageDecode, StageFree; a failed
+// stage is still reported, but the stages after it up to StageFree are not.
+type Observer func(stage string, d time.Duration)
+
+// Stages of a translation reported to an Observer.
+const (
+	// StageWrite covers encoding the request and copying it into WASM
+	// memory, including the call to the module's malloc.
+	StageWrite = "write"
+	// StageInvoke is the module's translation itself.
+	StageInvoke = "invoke"
+	// StageRead covers copying the response out of WASM memory.
+	StageRead = "read"
+	// StageDecode covers decoding the response into a Shader.
+	StageDecode = "decode"
+	// StageFree is the call to the module's free for the request.
+	StageFree = "free"
+)
+
+// TranslatorConfig holds the settings of a ShaderTranslator, as set by the
+// TranslatorOptions passed to NewShaderTranslator.
+type TranslatorConfig struct {
+	// MaxResponseSize is the largest module response, in bytes, the
+	// translator accepts. Longer responses, and responses without a null
+	// terminator within the bound, fail with ErrProtocol.
+	MaxResponseSize int
+	// ModuleName is the name of the wazero module instance, as it appears in
+	// wazero errors, stack traces and listeners.
+	ModuleName string
+	// Engine is the wazero engine that runs the module.
+	Engine Engine
+	// Observer, if set, is called after each stage of every translation.
+	Observer Observer
+}
+
+// TranslatorOption configures a ShaderTranslator.
+type TranslatorOption func(*TranslatorConfig)
+
+// WithMaxResponseSize sets TranslatorConfig.MaxResponseSize. The default is
+// 4 MiB; values below 1 keep the default.
+func WithMaxResponseSize(n int) TranslatorOption {
+	return func(c *TranslatorConfig) {
+		if n > 0 {
+			c.MaxResponseSize = n
+		}
+	}
+}
+
+// WithModuleName sets TranslatorConfig.ModuleName. The default is "angle";
+// an empty name keeps the default.
+func WithModuleName(name string) TranslatorOption {
+	return func(c *TranslatorConfig) {
+		if name != "" {
+			c.ModuleName = name
+		}
+	}
+}
+
+// WithCompiler sets TranslatorConfig.Engine to EngineCompiler. Where the
+// optimizing compiler does not support the platform, NewShaderTranslator
+// returns an ErrRuntime error, so prefer the default EngineAuto unless the
+// compiler must be enforced.
+func WithCompiler() TranslatorOption {
+	return func(c *TranslatorConfig) {
+		c.Engine = EngineCompiler
+	}
+}
+
+// WithInterpreter sets TranslatorConfig.Engine to EngineInterpreter, for
+// platforms without compiler support or for debugging without native code.
+func WithInterpreter() TranslatorOption {
+	return func(c *TranslatorConfig) {
+		c.Engine = EngineInterpreter
+	}
+}
+
+// WithObserver sets TranslatorConfig.Observer. The default is none.
+func WithObserver(o Observer) TranslatorOption {
+	return func(c *TranslatorConfig) {
+		c.Observer = o
+	}
+}
+
+// runtimeConfig returns the wazero runtime configuration for the engine.
+func (c TranslatorConfig) runtimeConfig() wazero.RuntimeConfig {
+	var rc wazero.RuntimeConfig
+	switch c.Engine {
+	case EngineCompiler:
+		rc = wazero.NewRuntimeConfigCompiler()
+	case EngineInterpreter:
+		rc = wazero.NewRuntimeConfigInterpreter()
+	default:
+		rc = wazero.NewRuntimeConfig()
+	}
+	return rc.WithCompilationCache(compilationCache)
+}
+
+// newTranslatorConfig applies opts to the default configuration.
+func newTranslatorConfig(opts []TranslatorOption) TranslatorConfig {
+	config := TranslatorConfig{
+		MaxResponseSize: defaultMaxResponseSize,
+		ModuleName:      defaultModuleName,
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return config
+}
+
+// Config returns the configuration st was created with, for recording how
+// its translations were produced. It is a copy, so changing it does not
+// affect st. Engine is as configured, so EngineAuto is not resolved to the
+// engine wazero picked, and it has no effect for a translator created with
+// NewShaderTranslatorFromCompiled.
+func (st *ShaderTranslator) Config() TranslatorConfig {
+	return st.config
+}
@@ -0,0 +1,166 @@
+package goshadertranslator
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DiagnosticSeverity is the severity prefix of an ANGLE info log line.
+type DiagnosticSeverity string
+
+const (
+	SeverityError   DiagnosticSeverity = "ERROR"
+	SeverityWarning DiagnosticSeverity = "WARNING"
+)
+
+// Diagnostic is a single message from ANGLE's info log.
+type Diagnostic struct {
+	Severity DiagnosticSeverity `json:"severity"`
+	// Source is the index of the source string the message refers to.
+	Source int `json:"source"`
+	// Line is the 1-based line number, or 0 when the message has none.
+	Line int `json:"line"`
+	// Token is the quoted token ANGLE reports the message against, if any.
+	Token   string `json:"token,omitempty"`
+	Message string `json:"message"`
+}
+
+// String formats the diagnostic the way ANGLE prints it.
+func (d Diagnostic) String() string {
+	if d.Token != "" {
+		return fmt.Sprintf("%s: %d:%d: '%s' : %s", d.Severity, d.Source, d.Line, d.Token, d.Message)
+	}
+	return fmt.Sprintf("%s: %d:%d: %s", d.Severity, d.Source, d.Line, d.Message)
+}
+
+// diagnosticLine matches lines such as "WARNING: 0:3: 'mytool' : unrecognized pragma".
+var diagnosticLine = regexp.MustCompile(`^([A-Z]+):\s*(\d+):(\d+):\s*(?:'([^']*)'\s*:\s*)?(.*)$`)
+
+// parseDiagnostics splits an ANGLE info log into diagnostics. Lines that do
+// not follow ANGLE's format are kept as messages without a severity.
+func parseDiagnostics(infoLog string) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, line := range strings.Split(infoLog, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		m := diagnosticLine.FindStringSubmatch(line)
+		if m == nil {
+			diagnostics = append(diagnostics, Diagnostic{Message: line})
+			continue
+		}
+		source, _ := strconv.Atoi(m[2])
+		lineNumber, _ := strconv.Atoi(m[3])
+		diagnostics = append(diagnostics, Diagnostic{
+			Severity: DiagnosticSeverity(m[1]),
+			Source:   source,
+			Line:     lineNumber,
+			Token:    m[4],
+			Message:  strings.TrimSpace(m[5]),
+		})
+	}
+	return diagnostics
+}
+
+// filterDiagnostics returns the diagnostics with the given severity.
+func filterDiagnostics(diagnostics []Diagnostic, severity DiagnosticSeverity) []Diagnostic {
+	var filtered []Diagnostic
+	for _, d := range diagnostics {
+		if d.Severity == severity {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// errorCodeCompile is the module's JSON-RPC error code for a shader that
+// failed to compile.
+const errorCodeCompile = 2
+
+// TranslateError is returned when the module rejects a shader, or when a
+// successful translation fails a check requested in TranslateOptions.
+type TranslateError struct {
+	// Code is the JSON-RPC error code reported by the module, or 0 for
+	// failures detected by this package.
+	Code        int
+	Message     string
+	InfoLog     string
+	Diagnostics []Diagnostic
+}
+
+func (e *TranslateError) Error() string {
+	return fmt.Sprintf("%s\n%s", e.Message, e.InfoLog)
+}
+
+// Unwrap returns ErrCompile when ANGLE rejected the shader and ErrValidation
+// for every other failure, so callers can branch with errors.Is.
+func (e *TranslateError) Unwrap() error {
+	if e.Code == errorCodeCompile {
+		return ErrCompile
+	}
+	return ErrValidation
+}
+
+// highpDowngrades returns a warning for each line of a fragment shader
+// source that uses highp. Under ShaderSpecWebGLN, ANGLE silently lowers a
+// highp variable qualifier to mediump; a "precision highp" statement is a
+// compile error instead, so it never gets this far. Lines in the branch of
+// an #ifdef, #ifndef or #if on GL_FRAGMENT_PRECISION_HIGH that the spec
+// leaves out are skipped, so the usual fallback idiom does not warn.
+func highpDowngrades(source string) []Diagnostic {
+	// conditional tracks an open #if; branches of conditionals on anything
+	// but GL_FRAGMENT_PRECISION_HIGH are taken as compiled
+	type conditional struct {
+		known, skipped bool
+	}
+	var conditionals []conditional
+	var diagnostics []Diagnostic
+	for i, line := range strings.Split(stripComments(source), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") {
+			fields := strings.Fields(strings.TrimSpace(trimmed[1:]))
+			if len(fields) == 0 {
+				continue
+			}
+			onHighp := strings.Contains(trimmed, "GL_FRAGMENT_PRECISION_HIGH")
+			negated := strings.Contains(trimmed, "!")
+			top := len(conditionals) - 1
+			switch fields[0] {
+			case "ifdef":
+				conditionals = append(conditionals, conditional{known: onHighp, skipped: onHighp})
+			case "ifndef":
+				conditionals = append(conditionals, conditional{known: onHighp})
+			case "if":
+				conditionals = append(conditionals, conditional{known: onHighp, skipped: onHighp && !negated})
+			case "elif":
+				if top >= 0 {
+					conditionals[top] = conditional{skipped: onHighp && !negated}
+				}
+			case "else":
+				if top >= 0 {
+					c := &conditionals[top]
+					c.skipped = c.known && !c.skipped
+				}
+			case "endif":
+				if top >= 0 {
+					conditionals = conditionals[:top]
+				}
+			}
+			continue
+		}
+		if !codeUsesAny(line, "highp") || slices.ContainsFunc(conditionals, func(c conditional) bool { return c.skipped }) {
+			continue
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			Severity: SeverityWarning,
+			Line:     i + 1,
+			Token:    "highp",
+			Message:  "highp is not supported in fragment shaders under webgln; mediump is used instead",
+		})
+	}
+	return diagnostics
+}
@@ -0,0 +1,172 @@
+package goshadertranslator
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// ReflectionDiff compares the interface of two translations of a shader and
+// returns one message per difference that invalidates state built against
+// old, such as a uniform added or removed, an attribute moved to another
+// location, a changed binding or a block member at a new offset. Messages
+// look like `uniform "tint": added` or `uniform "tex": binding 0 -> 1` and
+// are grouped by kind and sorted by name; nil means the interfaces match.
+// Default-block uniforms (including samplers and images), attributes and
+// uniform and storage blocks are compared; precision and static use are not.
+func ReflectionDiff(old, new *Shader) []string {
+	var changes []string
+	diffVariables(&changes, "uniform", old.uniforms(), new.uniforms())
+	diffVariables(&changes, "attribute", old.Attributes(), new.Attributes())
+	diffBlocks(&changes, old.Blocks, new.Blocks)
+	return changes
+}
+
+// uniforms returns the default-block uniforms of s.
+func (s *Shader) uniforms() []ShaderVariable {
+	var uniforms []ShaderVariable
+	for _, v := range s.Variables {
+		if v.Category == categoryUniforms {
+			uniforms = append(uniforms, v)
+		}
+	}
+	return uniforms
+}
+
+// diffVariables reports the variables only one of old and new contains and
+// the changes of those both contain, matching them by name.
+func diffVariables(changes *[]string, kind string, old, new []ShaderVariable) {
+	oldByName := make(map[string]ShaderVariable, len(old))
+	for _, v := range old {
+		oldByName[v.Name] = v
+	}
+	newByName := make(map[string]ShaderVariable, len(new))
+	for _, v := range new {
+		newByName[v.Name] = v
+	}
+	for _, name := range unionKeys(oldByName, newByName) {
+		a, inOld := oldByName[name]
+		b, inNew := newByName[name]
+		switch {
+		case !inNew:
+			*changes = append(*changes, fmt.Sprintf("%s %q: removed", kind, name))
+		case !inOld:
+			*changes = append(*changes, fmt.Sprintf("%s %q: added", kind, name))
+		default:
+			diffVariable(changes, kind, name, a, b)
+		}
+	}
+}
+
+// diffVariable reports how the type and layout of b differ from a.
+func diffVariable(changes *[]string, kind, name string, a, b ShaderVariable) {
+	changed := func(what string, from, to interface{}) {
+		*changes = append(*changes, fmt.Sprintf("%s %q: %s %v -> %v", kind, name, what, from, to))
+	}
+	if a.Type != b.Type {
+		changed("type", fmt.Sprintf("0x%04X", a.Type), fmt.Sprintf("0x%04X", b.Type))
+	}
+	if a.StructName != b.StructName {
+		changed("struct", a.StructName, b.StructName)
+	}
+	if !slices.Equal(a.ArraySizes, b.ArraySizes) {
+		changed("array sizes", a.ArraySizes, b.ArraySizes)
+	}
+	if a.Location != b.Location {
+		changed("location", a.Location, b.Location)
+	}
+	if a.Binding != b.Binding {
+		changed("binding", a.Binding, b.Binding)
+	}
+	if a.Offset != b.Offset {
+		changed("offset", a.Offset, b.Offset)
+	}
+	if a.ArrayStride != b.ArrayStride {
+		changed("array stride", a.ArrayStride, b.ArrayStride)
+	}
+	if a.MatrixStride != b.MatrixStride {
+		changed("matrix stride", a.MatrixStride, b.MatrixStride)
+	}
+	if a.IsRowMajor != b.IsRowMajor {
+		changed("row major", a.IsRowMajor, b.IsRowMajor)
+	}
+	if len(a.Fields) > 0 || len(b.Fields) > 0 {
+		diffVariables(changes, kind, qualifiedFields(name, a.Fields), qualifiedFields(name, b.Fields))
+	}
+}
+
+// qualifiedFields returns fields with their names prefixed by the name of
+// the enclosing variable or block, as in "light.color".
+func qualifiedFields(prefix string, fields []ShaderVariable) []ShaderVariable {
+	qualified := make([]ShaderVariable, len(fields))
+	for i, f := range fields {
+		f.Name = prefix + "." + f.Name
+		qualified[i] = f
+	}
+	return qualified
+}
+
+// diffBlocks reports the blocks only one of old and new contains and the
+// layout changes of those both contain, matching them by category and name.
+func diffBlocks(changes *[]string, old, new []InterfaceBlock) {
+	kinds := map[string]string{
+		categoryUniformBlocks: "uniform block",
+		categoryStorageBlocks: "storage block",
+	}
+	key := func(b InterfaceBlock) string { return kinds[b.Category] + " " + b.Name }
+	oldByKey := make(map[string]InterfaceBlock, len(old))
+	for _, b := range old {
+		oldByKey[key(b)] = b
+	}
+	newByKey := make(map[string]InterfaceBlock, len(new))
+	for _, b := range new {
+		newByKey[key(b)] = b
+	}
+	for _, k := range unionKeys(oldByKey, newByKey) {
+		a, inOld := oldByKey[k]
+		b, inNew := newByKey[k]
+		kind := kinds[a.Category]
+		if !inOld {
+			kind = kinds[b.Category]
+		}
+		changed := func(what string, from, to interface{}) {
+			*changes = append(*changes, fmt.Sprintf("%s %q: %s %v -> %v", kind, a.Name, what, from, to))
+		}
+		switch {
+		case !inNew:
+			*changes = append(*changes, fmt.Sprintf("%s %q: removed", kind, a.Name))
+			continue
+		case !inOld:
+			*changes = append(*changes, fmt.Sprintf("%s %q: added", kind, b.Name))
+			continue
+		}
+		if a.Layout != b.Layout {
+			changed("layout", a.Layout, b.Layout)
+		}
+		if a.Binding != b.Binding {
+			changed("binding", a.Binding, b.Binding)
+		}
+		if a.ArraySize != b.ArraySize {
+			changed("array size", a.ArraySize, b.ArraySize)
+		}
+		if a.DataSize != b.DataSize {
+			changed("data size", a.DataSize, b.DataSize)
+		}
+		diffVariables(changes, kind+" member", qualifiedFields(a.Name, a.Fields), qualifiedFields(b.Name, b.Fields))
+	}
+}
+
+// unionKeys returns the keys of a and b, sorted.
+func unionKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,40 @@
+package goshadertranslator
+
+import "errors"
+
+// Sentinel errors for classifying failures with errors.Is.
+var (
+	// ErrCompile is wrapped by a *TranslateError for a shader ANGLE rejects.
+	ErrCompile = errors.New("shader compilation failed")
+	// ErrValidation is wrapped by errors for requests the module refuses
+	// (such as an unsupported output format) and for translations that fail
+	// a check requested in TranslateOptions.
+	ErrValidation = errors.New("shader validation failed")
+	// ErrProtocol is wrapped by errors for malformed or mismatched module
+	// responses.
+	ErrProtocol = errors.New("wasm protocol error")
+	// ErrRuntime is wrapped by errors from wazero or the module's memory.
+	ErrRuntime = errors.New("wasm runtime error")
+	// ErrClosed is wrapped by errors from a translator that has been closed.
+	ErrClosed = errors.New("translator has been closed")
+)
+
+// classifiedError ties an error to one of the sentinels without changing its
+// message.
+type classifiedError struct {
+	kind error
+	err  error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// classify returns err wrapped so that errors.Is(err, kind) reports true.
+func classify(kind, err error) error {
+	return &classifiedError{kind: kind, err: err}
+}
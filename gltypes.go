@@ -0,0 +1,198 @@
+package goshadertranslator
+
+// GL precision enums as reported in ShaderVariable.Precision.
+const (
+	glLowFloat    = 0x8DF0
+	glMediumFloat = 0x8DF1
+	glHighFloat   = 0x8DF2
+	glLowInt      = 0x8DF3
+	glMediumInt   = 0x8DF4
+	glHighInt     = 0x8DF5
+)
+
+// precisionQualifier returns the GLSL ES qualifier for a precision enum,
+// or "" when the variable has no precision.
+func precisionQualifier(precision uint) string {
+	switch precision {
+	case glLowFloat, glLowInt:
+		return "lowp"
+	case glMediumFloat, glMediumInt:
+		return "mediump"
+	case glHighFloat, glHighInt:
+		return "highp"
+	}
+	return ""
+}
+
+// GL type enums as reported in ShaderVariable.Type.
+const (
+	glFloat       = 0x1406
+	glFloatVec2   = 0x8B50
+	glFloatVec3   = 0x8B51
+	glFloatVec4   = 0x8B52
+	glInt         = 0x1404
+	glIntVec2     = 0x8B53
+	glIntVec3     = 0x8B54
+	glIntVec4     = 0x8B55
+	glUnsignedInt = 0x1405
+	glUintVec2    = 0x8DC6
+	glUintVec3    = 0x8DC7
+	glUintVec4    = 0x8DC8
+	glBool        = 0x8B56
+	glBoolVec2    = 0x8B57
+	glBoolVec3    = 0x8B58
+	glBoolVec4    = 0x8B59
+	glFloatMat2   = 0x8B5A
+	glFloatMat3   = 0x8B5B
+	glFloatMat4   = 0x8B5C
+	glFloatMat2x3 = 0x8B65
+	glFloatMat2x4 = 0x8B66
+	glFloatMat3x2 = 0x8B67
+	glFloatMat3x4 = 0x8B68
+	glFloatMat4x2 = 0x8B69
+	glFloatMat4x3 = 0x8B6A
+)
+
+// glTypeShape describes the numeric layout of a non-opaque GL type.
+type glTypeShape struct {
+	component uint // glFloat, glInt, glUnsignedInt or glBool
+	columns   int  // 1 for scalars and vectors
+	rows      int  // components per column
+}
+
+var glTypeShapes = map[uint]glTypeShape{
+	glFloat:       {glFloat, 1, 1},
+	glFloatVec2:   {glFloat, 1, 2},
+	glFloatVec3:   {glFloat, 1, 3},
+	glFloatVec4:   {glFloat, 1, 4},
+	glInt:         {glInt, 1, 1},
+	glIntVec2:     {glInt, 1, 2},
+	glIntVec3:     {glInt, 1, 3},
+	glIntVec4:     {glInt, 1, 4},
+	glUnsignedInt: {glUnsignedInt, 1, 1},
+	glUintVec2:    {glUnsignedInt, 1, 2},
+	glUintVec3:    {glUnsignedInt, 1, 3},
+	glUintVec4:    {glUnsignedInt, 1, 4},
+	glBool:        {glBool, 1, 1},
+	glBoolVec2:    {glBool, 1, 2},
+	glBoolVec3:    {glBool, 1, 3},
+	glBoolVec4:    {glBool, 1, 4},
+	glFloatMat2:   {glFloat, 2, 2},
+	glFloatMat3:   {glFloat, 3, 3},
+	glFloatMat4:   {glFloat, 4, 4},
+	glFloatMat2x3: {glFloat, 2, 3},
+	glFloatMat2x4: {glFloat, 2, 4},
+	glFloatMat3x2: {glFloat, 3, 2},
+	glFloatMat3x4: {glFloat, 3, 4},
+	glFloatMat4x2: {glFloat, 4, 2},
+	glFloatMat4x3: {glFloat, 4, 3},
+}
+
+// arrayElementCount returns the total number of elements described by
+// arraySizes, or 1 for a non-array.
+func arrayElementCount(arraySizes []uint) int {
+	n := 1
+	for _, size := range arraySizes {
+		n *= int(size)
+	}
+	return n
+}
+
+// attributeSlotCount returns the number of vertex attribute locations a
+// variable of the given type and array sizes occupies. Matrices take one
+// location per column.
+func attributeSlotCount(glType uint, arraySizes []uint) int {
+	shape, ok := glTypeShapes[glType]
+	if !ok {
+		return 0
+	}
+	return shape.columns * arrayElementCount(arraySizes)
+}
+
+// Opaque GL type enums for samplers and images.
+const (
+	glSampler2D                            = 0x8B5E
+	glSampler3D                            = 0x8B5F
+	glSamplerCube                          = 0x8B60
+	glSampler2DShadow                      = 0x8B62
+	glSampler2DRect                        = 0x8B63
+	glSampler2DArray                       = 0x8DC1
+	glSamplerBuffer                        = 0x8DC2
+	glSampler2DArrayShadow                 = 0x8DC4
+	glSamplerCubeShadow                    = 0x8DC5
+	glIntSampler2D                         = 0x8DCA
+	glIntSampler3D                         = 0x8DCB
+	glIntSamplerCube                       = 0x8DCC
+	glIntSampler2DArray                    = 0x8DCF
+	glIntSamplerBuffer                     = 0x8DD0
+	glUnsignedIntSampler2D                 = 0x8DD2
+	glUnsignedIntSampler3D                 = 0x8DD3
+	glUnsignedIntSamplerCube               = 0x8DD4
+	glUnsignedIntSampler2DArray            = 0x8DD7
+	glUnsignedIntSamplerBuffer             = 0x8DD8
+	glSamplerExternalOES                   = 0x8D66
+	glSamplerExternal2DY2YEXT              = 0x8BE7
+	glSamplerCubeMapArray                  = 0x900C
+	glSamplerCubeMapArrayShadow            = 0x900D
+	glIntSamplerCubeMapArray               = 0x900E
+	glUnsignedIntSamplerCubeMapArray       = 0x900F
+	glSampler2DMultisample                 = 0x9108
+	glIntSampler2DMultisample              = 0x9109
+	glUnsignedIntSampler2DMultisample      = 0x910A
+	glSampler2DMultisampleArray            = 0x910B
+	glIntSampler2DMultisampleArray         = 0x910C
+	glUnsignedIntSampler2DMultisampleArray = 0x910D
+
+	glImage2D                      = 0x904D
+	glImage3D                      = 0x904E
+	glImageCube                    = 0x9050
+	glImageBuffer                  = 0x9051
+	glImage2DArray                 = 0x9053
+	glImageCubeMapArray            = 0x9054
+	glIntImage2D                   = 0x9058
+	glIntImage3D                   = 0x9059
+	glIntImageCube                 = 0x905B
+	glIntImageBuffer               = 0x905C
+	glIntImage2DArray              = 0x905E
+	glIntImageCubeMapArray         = 0x905F
+	glUnsignedIntImage2D           = 0x9063
+	glUnsignedIntImage3D           = 0x9064
+	glUnsignedIntImageCube         = 0x9066
+	glUnsignedIntImageBuffer       = 0x9067
+	glUnsignedIntImage2DArray      = 0x9069
+	glUnsignedIntImageCubeMapArray = 0x906A
+)
+
+var glSamplerTypes = map[uint]bool{
+	glSampler2D: true, glSampler3D: true, glSamplerCube: true, glSampler2DShadow: true,
+	glSampler2DRect: true, glSampler2DArray: true, glSamplerBuffer: true,
+	glSampler2DArrayShadow: true, glSamplerCubeShadow: true,
+	glIntSampler2D: true, glIntSampler3D: true, glIntSamplerCube: true,
+	glIntSampler2DArray: true, glIntSamplerBuffer: true,
+	glUnsignedIntSampler2D: true, glUnsignedIntSampler3D: true, glUnsignedIntSamplerCube: true,
+	glUnsignedIntSampler2DArray: true, glUnsignedIntSamplerBuffer: true,
+	glSamplerExternalOES: true, glSamplerExternal2DY2YEXT: true,
+	glSamplerCubeMapArray: true, glSamplerCubeMapArrayShadow: true,
+	glIntSamplerCubeMapArray: true, glUnsignedIntSamplerCubeMapArray: true,
+	glSampler2DMultisample: true, glIntSampler2DMultisample: true,
+	glUnsignedIntSampler2DMultisample: true, glSampler2DMultisampleArray: true,
+	glIntSampler2DMultisampleArray: true, glUnsignedIntSampler2DMultisampleArray: true,
+}
+
+// glMultisampleSamplerTypes lists the sampler types of multisample
+// textures, which are read with texelFetch and a sample index.
+var glMultisampleSamplerTypes = map[uint]bool{
+	glSampler2DMultisample: true, glIntSampler2DMultisample: true,
+	glUnsignedIntSampler2DMultisample: true, glSampler2DMultisampleArray: true,
+	glIntSampler2DMultisampleArray: true, glUnsignedIntSampler2DMultisampleArray: true,
+}
+
+var glImageTypes = map[uint]bool{
+	glImage2D: true, glImage3D: true, glImageCube: true, glImageBuffer: true,
+	glImage2DArray: true, glImageCubeMapArray: true,
+	glIntImage2D: true, glIntImage3D: true, glIntImageCube: true, glIntImageBuffer: true,
+	glIntImage2DArray: true, glIntImageCubeMapArray: true,
+	glUnsignedIntImage2D: true, glUnsignedIntImage3D: true, glUnsignedIntImageCube: true,
+	glUnsignedIntImageBuffer: true, glUnsignedIntImage2DArray: true,
+	glUnsignedIntImageCubeMapArray: true,
+}
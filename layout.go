@@ -0,0 +1,162 @@
+package goshadertranslator
+
+import (
+	"sort"
+	"strconv"
+)
+
+// The module does not report block member offsets, so they are computed
+// here from the std140 and std430 rules of the GLSL ES 3.10 specification
+// (section 7.6.2.2). Blocks with the "shared" or "packed" layout have
+// implementation-defined offsets and are left without them.
+
+// roundUp rounds n up to a multiple of align.
+func roundUp(n, align int) int {
+	if align <= 0 {
+		return n
+	}
+	return (n + align - 1) / align * align
+}
+
+// vectorAlignment returns the base alignment of a vector with n components.
+func vectorAlignment(n int) int {
+	switch n {
+	case 1:
+		return 4
+	case 2:
+		return 8
+	}
+	return 16
+}
+
+// layoutVariable sets the offsets and strides of v and its fields and
+// returns the size and base alignment of v. Field offsets are relative to
+// the start of the enclosing struct.
+func layoutVariable(v *ShaderVariable, std430 bool) (size, align int) {
+	if len(v.Fields) > 0 {
+		offset := 0
+		for i := range v.Fields {
+			field := &v.Fields[i]
+			fieldSize, fieldAlign := layoutVariable(field, std430)
+			offset = roundUp(offset, fieldAlign)
+			field.Offset = offset
+			offset += fieldSize
+			if fieldAlign > align {
+				align = fieldAlign
+			}
+		}
+		if !std430 {
+			align = roundUp(align, 16)
+		}
+		size = roundUp(offset, align)
+	} else if shape, ok := glTypeShapes[v.Type]; ok {
+		if shape.columns == 1 {
+			size, align = 4*shape.rows, vectorAlignment(shape.rows)
+		} else {
+			// a matrix is laid out as an array of column (or row) vectors
+			vectors, components := shape.columns, shape.rows
+			if v.IsRowMajor {
+				vectors, components = components, vectors
+			}
+			align = vectorAlignment(components)
+			if !std430 {
+				align = 16
+			}
+			v.MatrixStride = align
+			size = vectors * align
+		}
+	}
+
+	if len(v.ArraySizes) > 0 {
+		if !std430 {
+			align = roundUp(align, 16)
+		}
+		v.ArrayStride = roundUp(size, align)
+		size = v.ArrayStride * arrayElementCount(v.ArraySizes)
+	}
+	return size, align
+}
+
+// setMatrixLayout makes IsRowMajor hold for exactly the row-major matrices
+// among v and its fields. ANGLE marks every member declared row_major, be
+// it a scalar, vector or struct, but not the matrices nested in a row_major
+// struct member, which inherit its layout.
+func setMatrixLayout(v *ShaderVariable, rowMajor bool) {
+	rowMajor = rowMajor || v.IsRowMajor
+	if len(v.Fields) > 0 {
+		v.IsRowMajor = false
+		for i := range v.Fields {
+			setMatrixLayout(&v.Fields[i], rowMajor)
+		}
+		return
+	}
+	v.IsRowMajor = rowMajor && glTypeShapes[v.Type].columns > 1
+}
+
+// layoutBlock computes the member offsets and data size of b when it uses
+// the std140 or std430 layout.
+func layoutBlock(b *InterfaceBlock) {
+	var std430 bool
+	switch b.Layout {
+	case "std140":
+	case "std430":
+		std430 = true
+	default:
+		return
+	}
+	offset, align := 0, 0
+	for i := range b.Fields {
+		field := &b.Fields[i]
+		fieldSize, fieldAlign := layoutVariable(field, std430)
+		offset = roundUp(offset, fieldAlign)
+		field.Offset = offset
+		offset += fieldSize
+		if fieldAlign > align {
+			align = fieldAlign
+		}
+	}
+	if !std430 {
+		align = roundUp(align, 16)
+	}
+	b.DataSize = roundUp(offset, align)
+}
+
+// SizeBytes returns the number of bytes a buffer bound to one instance of
+// the block must hold: its std140 or std430 DataSize, with the end padding
+// the layout rules require. An array of blocks binds each instance
+// separately, so the size is per instance. For a storage block ending in a
+// runtime-sized array, the size covers the members before it. It is 0 for
+// the shared and packed layouts, whose size only the driver knows.
+func (b InterfaceBlock) SizeBytes() int {
+	return b.DataSize
+}
+
+// annotateOffsets appends an "// offset N" comment to the declaration of
+// each top-level member of the std140 and std430 blocks in code.
+func annotateOffsets(code string, blocks []InterfaceBlock) string {
+	type insertion struct {
+		at      int
+		comment string
+	}
+	var insertions []insertion
+	for _, b := range blocks {
+		start, end, ok := findBlockBody(code, b.MappedName)
+		if !ok {
+			continue
+		}
+		for _, field := range b.Fields {
+			if field.Offset < 0 {
+				continue
+			}
+			if m := declarationPattern(field.MappedName).FindStringIndex(code[start:end]); m != nil {
+				insertions = append(insertions, insertion{start + m[1], " // offset " + strconv.Itoa(field.Offset)})
+			}
+		}
+	}
+	// insert from the end so earlier positions stay valid
+	sort.Slice(insertions, func(i, j int) bool { return insertions[i].at > insertions[j].at })
+	for _, in := range insertions {
+		code = code[:in.at] + in.comment + code[in.at:]
+	}
+	return code
+}
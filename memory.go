@@ -0,0 +1,90 @@
+package goshadertranslator
+
+import "strings"
+
+// MemoryQualifiers is a set of the memory qualifiers of an image uniform or
+// a shader storage block member.
+type MemoryQualifiers uint8
+
+// The memory qualifiers, one bit each.
+const (
+	MemoryReadonly MemoryQualifiers = 1 << iota
+	MemoryWriteonly
+	MemoryCoherent
+	MemoryVolatile
+	MemoryRestrict
+)
+
+// memoryQualifierNames maps each qualifier to its GLSL keyword.
+var memoryQualifierNames = []struct {
+	qualifier MemoryQualifiers
+	name      string
+}{
+	{MemoryReadonly, "readonly"},
+	{MemoryWriteonly, "writeonly"},
+	{MemoryCoherent, "coherent"},
+	{MemoryVolatile, "volatile"},
+	{MemoryRestrict, "restrict"},
+}
+
+// String returns the GLSL keywords of the qualifiers in q, separated by
+// spaces, or "" when q is empty.
+func (q MemoryQualifiers) String() string {
+	var names []string
+	for _, m := range memoryQualifierNames {
+		if q&m.qualifier != 0 {
+			names = append(names, m.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// parseMemoryQualifiers returns the memory qualifiers among the words of a
+// declaration.
+func parseMemoryQualifiers(declaration string) MemoryQualifiers {
+	var q MemoryQualifiers
+	for _, word := range strings.Fields(declaration) {
+		for _, m := range memoryQualifierNames {
+			if word == m.name {
+				q |= m.qualifier
+			}
+		}
+	}
+	return q
+}
+
+// declarationQualifiers returns the memory qualifiers of the declaration of
+// name in code, without the layout qualifier.
+func declarationQualifiers(code, name string) MemoryQualifiers {
+	m := declarationPattern(name).FindString(code)
+	if m == "" {
+		return 0
+	}
+	return parseMemoryQualifiers(m[:strings.LastIndex(m, name)])
+}
+
+// setMemoryQualifiers fills in the MemoryQualifiers of image uniforms and
+// storage block members. The module does not report them, so they are read
+// from the declarations in the translated code, where ANGLE repeats the
+// qualifiers of a storage block on each of its members.
+func setMemoryQualifiers(code string, variables map[string]ShaderVariable, blocks []InterfaceBlock) {
+	for name, v := range variables {
+		if v.Category == categoryUniforms && glImageTypes[v.Type] {
+			v.MemoryQualifiers = declarationQualifiers(code, v.MappedName)
+			variables[name] = v
+		}
+	}
+	for i := range blocks {
+		block := &blocks[i]
+		if block.Category != categoryStorageBlocks {
+			continue
+		}
+		start, end, ok := findBlockBody(code, block.MappedName)
+		if !ok {
+			continue
+		}
+		for j := range block.Fields {
+			block.Fields[j].MemoryQualifiers = declarationQualifiers(code[start:end], block.Fields[j].MappedName)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package goshadertranslator
+
+import "strings"
+
+// userNamePrefix is the prefix ANGLE adds to every user-defined identifier
+// when name hashing is not enabled.
+const userNamePrefix = "_u"
+
+// renameUserNames rewrites every ANGLE-prefixed identifier in the shader's
+// code and metadata with rename, which receives the identifier without the
+// prefix.
+func (s *Shader) renameUserNames(rename func(name string) string) {
+	mapName := func(ident string) string {
+		if name, ok := strings.CutPrefix(ident, userNamePrefix); ok && name != "" {
+			return rename(name)
+		}
+		return ident
+	}
+	s.Code = replaceIdentifiers(s.Code, mapName)
+	for key, v := range s.Variables {
+		s.Variables[key] = renameVariable(v, mapName)
+	}
+	for i := range s.Blocks {
+		b := &s.Blocks[i]
+		b.MappedName = mapName(b.MappedName)
+		for j := range b.Fields {
+			b.Fields[j] = renameVariable(b.Fields[j], mapName)
+		}
+	}
+}
+
+func renameVariable(v ShaderVariable, mapName func(string) string) ShaderVariable {
+	v.MappedName = mapName(v.MappedName)
+	if len(v.Fields) > 0 {
+		fields := make([]ShaderVariable, len(v.Fields))
+		for i, f := range v.Fields {
+			fields[i] = renameVariable(f, mapName)
+		}
+		v.Fields = fields
+	}
+	return v
+}
+
+// synthesizedOutputs maps the ESSL 1.00 fragment outputs to the out
+// variables ANGLE declares in their place in GLSL 1.30 and newer output.
+var synthesizedOutputs = map[string]string{
+	"gl_FragColor": "webgl_FragColor",
+	"gl_FragData":  "webgl_FragData",
+}
+
+// mapSynthesizedOutputs sets the MappedName of gl_FragColor and gl_FragData
+// to the out variable ANGLE declared for them, renamed to name in s.Code
+// when name is not empty.
+func (s *Shader) mapSynthesizedOutputs(name string) {
+	for builtin, synthesized := range synthesizedOutputs {
+		v, ok := s.Variables[builtin]
+		if !ok || v.Category != categoryOutputVariables || !codeUsesAny(s.Code, synthesized) {
+			continue
+		}
+		if name != "" {
+			s.Code = replaceIdentifiers(s.Code, func(ident string) string {
+				if ident == synthesized {
+					return name
+				}
+				return ident
+			})
+			synthesized = name
+		}
+		v.MappedName = synthesized
+		s.Variables[builtin] = v
+	}
+}
+
+// glslReservedWords maps the keywords and reserved words of desktop GLSL
+// that GLSL ES sources may still use as identifiers to the first GLSL
+// version that reserves them. Where a word was reserved for future use
+// before it became a keyword, the earlier version is used.
+var glslReservedWords = func() map[string]int {
+	words := map[string]int{
+		"packed": 110, "centroid": 120,
+		"case": 130, "smooth": 130, "noperspective": 130, "uint": 130,
+		"uvec2": 130, "uvec3": 130, "uvec4": 130,
+		"common": 130, "partition": 130, "active": 130, "filter": 130, "row_major": 130,
+		"layout": 140, "patch": 400, "sample": 400, "subroutine": 400, "precise": 400,
+		"coherent": 420, "restrict": 420, "readonly": 420, "writeonly": 420,
+		"atomic_uint": 420, "resource": 420, "buffer": 430, "shared": 430,
+	}
+	for _, n := range []string{"2", "3", "4"} {
+		words["dvec"+n] = 110
+		words["dmat"+n] = 400
+		for _, m := range []string{"2", "3", "4"} {
+			words["dmat"+n+"x"+m] = 400
+		}
+	}
+	samplers := map[string]int{
+		"1D": 110, "2D": 110, "3D": 110, "Cube": 110, "2DRect": 110,
+		"1DArray": 130, "2DArray": 130, "Buffer": 130,
+		"2DMS": 150, "2DMSArray": 150, "CubeArray": 400,
+	}
+	for kind, version := range samplers {
+		words["sampler"+kind] = version
+		words["isampler"+kind] = max(version, 130)
+		words["usampler"+kind] = max(version, 130)
+	}
+	shadowSamplers := map[string]int{
+		"1DShadow": 110, "2DShadow": 110, "2DRectShadow": 110, "CubeShadow": 130,
+		"1DArrayShadow": 130, "2DArrayShadow": 130, "CubeArrayShadow": 400,
+	}
+	for kind, version := range shadowSamplers {
+		words["sampler"+kind] = version
+	}
+	images := map[string]int{
+		"1D": 130, "2D": 130, "3D": 130, "Cube": 130, "Buffer": 130,
+		"1DArray": 130, "2DArray": 130,
+		"2DRect": 420, "CubeArray": 420, "2DMS": 420, "2DMSArray": 420,
+	}
+	for kind, version := range images {
+		for _, prefix := range []string{"", "i", "u"} {
+			words[prefix+"image"+kind] = version
+		}
+	}
+	return words
+}()
+
+// glslReserved reports whether name is a keyword or reserved word of
+// desktop GLSL version.
+func glslReserved(name string, version int) bool {
+	since, ok := glslReservedWords[name]
+	return ok && since <= version
+}
+
+// MappedNames maps the Name of every variable and interface block of the
+// shader to its MappedName, the name to bind it by in Code. With
+// TranslateOptions.DisableNameMapping most names map to themselves, except
+// those kept renamed because they are reserved in the desktop GLSL target.
+func (s *Shader) MappedNames() map[string]string {
+	names := make(map[string]string, len(s.Variables)+len(s.Blocks))
+	for _, v := range s.Variables {
+		names[v.Name] = v.MappedName
+	}
+	for _, b := range s.Blocks {
+		names[b.Name] = b.MappedName
+	}
+	return names
+}
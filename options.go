@@ -0,0 +1,564 @@
+package goshadertranslator
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GLSLProfile selects the profile named in a desktop GLSL #version directive.
+type GLSLProfile string
+
+const (
+	// GLSLProfileDefault leaves the directive as ANGLE emits it (no profile).
+	GLSLProfileDefault       GLSLProfile = ""
+	GLSLProfileCore          GLSLProfile = "core"
+	GLSLProfileCompatibility GLSLProfile = "compatibility"
+)
+
+// ExtensionBehavior is the behavior named in an #extension directive.
+type ExtensionBehavior string
+
+const (
+	// ExtensionRequire fails the translation if the extension is unsupported.
+	ExtensionRequire ExtensionBehavior = "require"
+	// ExtensionEnable enables the extension, warning if it is unsupported.
+	ExtensionEnable ExtensionBehavior = "enable"
+	// ExtensionWarn enables the extension but warns whenever it is used.
+	ExtensionWarn ExtensionBehavior = "warn"
+	// ExtensionDisable disables the extension.
+	ExtensionDisable ExtensionBehavior = "disable"
+)
+
+// MatrixLayout is the default matrix layout of uniform and storage blocks.
+type MatrixLayout string
+
+const (
+	// MatrixLayoutDefault keeps the layout the source declares.
+	MatrixLayoutDefault MatrixLayout = ""
+	// MatrixLayoutRowMajor stores block matrices row by row.
+	MatrixLayoutRowMajor MatrixLayout = "row_major"
+	// MatrixLayoutColumnMajor stores block matrices column by column.
+	MatrixLayoutColumnMajor MatrixLayout = "column_major"
+)
+
+// TranslateOptions holds optional settings for a single translation.
+// The zero value matches the behavior of TranslateShader.
+type TranslateOptions struct {
+	// Profile is appended to the #version directive of desktop GLSL output.
+	// Profiles only exist from GLSL 1.50 on, so it is honored for
+	// OutputFormatGLSL150, OutputFormatGLSL330 and OutputFormatGLSL400
+	// through OutputFormatGLSL450, and ignored for every other format.
+	Profile GLSLProfile
+
+	// PreservePrecision restores the precision qualifiers that ANGLE drops
+	// when emitting desktop GLSL. Only global interface variables (uniforms,
+	// attributes, varyings and fragment outputs) are covered. GLSL 1.30 and
+	// newer accept precision qualifiers, so OutputFormatGLSL130 and up get
+	// real qualifiers; OutputFormatGLSL gets them as trailing comments.
+	// ESSL output already keeps its qualifiers and is left untouched.
+	PreservePrecision bool
+
+	// StrictWarnings turns any warning ANGLE reports, and the highp
+	// warnings of ShaderSpecWebGLN fragment shaders, into a failure: the
+	// translation returns a *TranslateError listing every warning instead
+	// of a Shader.
+	StrictWarnings bool
+
+	// WarnNonUniformSampling adds a warning to Shader.Diagnostics for each
+	// implicit-LOD texture lookup (texture, texture2D and the like) in a
+	// fragment shader's non-uniform control flow, where GLES leaves the
+	// derivatives, and so the sampled level, undefined. ANGLE does not
+	// check this, so it is a best-effort scan of the source: a branch or
+	// loop counts as non-uniform unless its condition only names uniforms,
+	// constants and the loop counter, and lookups in called functions are
+	// not followed. The warnings are added after StrictWarnings is applied.
+	WarnNonUniformSampling bool
+
+	// DisableNameMapping removes the "_u" prefix ANGLE adds to every
+	// user-defined identifier, so the output uses the source names and each
+	// MappedName equals its Name. ANGLE itself cannot skip the mapping; the
+	// prefix exists to avoid clashes with reserved words and builtins of the
+	// target. For desktop GLSL outputs, names that are keywords or reserved
+	// words of the output's version (or of ForceVersion), such as "sample"
+	// in GLSL 4.00 or "buffer" in GLSL 4.30, keep the prefix, and their
+	// MappedName and Shader.MappedNames report it. Other targets, and
+	// clashes with builtin function names, are not checked, so disabling
+	// the mapping can still produce code that fails to compile there.
+	DisableNameMapping bool
+
+	// NamePrefix, when non-empty, replaces the "_u" prefix ANGLE adds to
+	// user-defined identifiers, in Code and in every MappedName, so with
+	// NamePrefix "my_" a uniform "color" is mapped to "my_color". The
+	// prefix must start an identifier and may not begin with "gl_" or
+	// contain "__"; it should also not produce names ANGLE generates
+	// itself, such as ones starting with "webgl_" or "_webgl_". It cannot
+	// be combined with DisableNameMapping, which amounts to an empty
+	// prefix.
+	NamePrefix string
+
+	// ForceVersion, when non-zero, replaces the #version directive of the
+	// output with this version (adding one to outputs that have none).
+	// A GLSL ES output keeps its "es" suffix and a desktop profile is kept
+	// for versions that have profiles. The code itself is not changed, so a
+	// warning is added to Shader.Diagnostics when the version does not exist
+	// for the output language or is older than the one the code was
+	// generated for.
+	ForceVersion int
+
+	// ESSLVersion, when non-zero, pins the #version directive of ESSL output
+	// to 100, 300, 310 or 320, for feeding the code to a GLES context of
+	// that version; "#version 100", which ANGLE omits, is added to ESSL 1.00
+	// code. Unlike ForceVersion it fails with ErrValidation instead
+	// of warning: when the output is not ESSL, when the spec (after
+	// MinGLVersion) does not allow that version, or when the code cannot
+	// run under it. ESSL 1.00 code, which ANGLE emits for 1.00 sources, can
+	// only be emitted as 100, and 3.x code can be raised to a newer 3.x
+	// version but not lowered. It cannot be combined with ForceVersion.
+	ESSLVersion int
+
+	// HeaderComment, when non-empty, is added to the top of Code as a //
+	// comment, one line per line of the text, right after the #version
+	// directive (which must stay first), for recording the source name,
+	// options or tool version in shipped shaders. It is added after every
+	// other option has been applied.
+	HeaderComment string
+
+	// MinGLVersion caps the feature set of the translation at an older
+	// context version, e.g. ShaderSpecGLES3 to keep shaders written against
+	// ShaderSpecGLES31 usable on GLES 3.0 devices. When it names an older
+	// version than the spec passed to the translate call, ANGLE validates
+	// the shader under the spec of that version in the same family (a WebGL
+	// spec stays a WebGL spec), so newer language versions, built-ins and
+	// resource defaults are rejected instead of emitted. A newer or equal
+	// version has no effect.
+	MinGLVersion ShaderSpec
+
+	// SkipActiveVariables stops the module from collecting and serializing
+	// the shader's variables, which saves time and memory when only Code is
+	// needed. Variables and Blocks stay empty, so everything derived from
+	// them (Reflect, Attributes, FitsResources and the like) reports nothing
+	// and PreservePrecision and OffsetComments have no effect. Combining it
+	// with RemoveUniforms fails, as the uniforms' use cannot be checked.
+	SkipActiveVariables bool
+
+	// SkipObjectCode has ANGLE validate the shader and report its variables
+	// and diagnostics without generating code, for analysis that only needs
+	// the metadata. Code stays empty, and so do the fields derived from it:
+	// UsesDerivatives, UsesInstanceID, UsesVertexID, ComputeLocalSize,
+	// EarlyFragmentTests and the MemoryQualifiers of images and storage
+	// block members. Options that only rewrite Code have no effect;
+	// combining it with AssignBlockBindings, which reads its result from
+	// Code, fails.
+	SkipObjectCode bool
+
+	// SortReflection makes Reflect return every slice sorted by name,
+	// including Attributes, which otherwise follow declaration order. Block
+	// members keep their declaration order, which their offsets depend on.
+	// Use it when reflection output must be byte-identical for equivalent
+	// sources, such as for a content-addressed cache.
+	SortReflection bool
+
+	// RawSource sends the source to ANGLE exactly as given. By default a
+	// leading UTF-8 byte order mark, which crashes the module, is removed
+	// and CRLF and lone CR line endings become LF, so sources saved on
+	// Windows translate like any other.
+	RawSource bool
+
+	// Resources overrides the module's built-in resource limits. Zero
+	// fields keep their defaults; nil keeps all of them. Only
+	// MaxVertexAttribs is sent; the other fields of Resources are offline
+	// checks for Shader.FitsResources.
+	Resources *Resources
+
+	// Extensions adds an "#extension name : behavior" directive after the
+	// #version line of the source for each entry, so ANGLE applies the GLSL
+	// semantics of each behavior: a required but unsupported extension fails
+	// the translation, an enabled one only warns. Which extensions count as
+	// supported depends on the spec and the module's resources. Directives
+	// in the source itself still apply after these.
+	Extensions map[string]ExtensionBehavior
+
+	// Defines adds a "#define name value" directive for each entry, like a
+	// compiler's -D flag; an empty value defines the macro without a body.
+	// ANGLE has no predefined macro input, so the directives are inserted
+	// after the #version line (and any Extensions directives), in name
+	// order. Reported line numbers still refer to the original source.
+	Defines map[string]string
+
+	// FragOutputName renames the out variable ANGLE declares in place of
+	// gl_FragColor or gl_FragData (webgl_FragColor and webgl_FragData) when
+	// an ESSL 1.00 fragment shader is translated to GLSL 1.30 or newer. The
+	// MappedName of the gl_FragColor or gl_FragData variable names the
+	// declared output either way, so it can be bound with
+	// glBindFragDataLocation; as the only output it gets location 0 by
+	// default. The name must be a valid identifier that the shader does not
+	// use otherwise.
+	FragOutputName string
+
+	// AssignBlockBindings gives each uniform and storage block that has no
+	// layout(binding = N) in the source the lowest binding nobody else uses
+	// in its binding space (uniform buffers and storage buffers count
+	// separately), in declaration order, and writes it into the block's
+	// layout qualifier in Code and into InterfaceBlock.Binding. Bindings
+	// declared in the source are kept and are never handed out again. ANGLE
+	// only assigns bindings for its Vulkan backend, so this is done after
+	// translation.
+	AssignBlockBindings bool
+
+	// OffsetComments appends an "// offset N" comment with the byte offset
+	// of ShaderVariable.Offset to each member of the std140 and std430
+	// blocks in Code, for inspecting block layouts. Members of nested structs
+	// are not annotated.
+	OffsetComments bool
+
+	// MatrixLayout sets the default matrix layout of uniform blocks (and of
+	// storage blocks from ESSL 3.10 on) by adding a "layout(row_major)
+	// uniform;" style default declaration to the source, so the generated
+	// block members carry the qualifier and ShaderVariable.IsRowMajor
+	// reflects it. Qualifiers on a block or member in the source still win.
+	// Default-block uniforms are always column-major, and ESSL 1.00 sources,
+	// which have no blocks, are left untouched.
+	MatrixLayout MatrixLayout
+
+	// RemoveUniforms names default-block uniforms to delete from Code and
+	// Variables, freeing their slots. ANGLE has no targeted dead-code
+	// elimination, so the declarations are removed after translation. Only
+	// uniforms the shader never statically uses can be removed; naming a used
+	// one fails the translation. Names the shader does not declare are ignored.
+	RemoveUniforms []string
+
+	// RawCompileOptions is an unsupported escape hatch for compile options
+	// that have no typed field yet. Keys use the module's snake_case names
+	// (e.g. "object_code"); they are merged after the typed fields, so they
+	// can also turn a typed option back off. Keys the module does not know
+	// are silently ignored.
+	RawCompileOptions map[string]bool
+}
+
+// supportedCompileOptions lists the compile_options keys the embedded
+// wasm_out module reads.
+var supportedCompileOptions = []string{
+	"intermediate_tree",
+	"object_code",
+	"initialize_uninitialized_locals",
+	"initialize_builtins_for_instanced_multiview",
+	"select_view_in_nv_glsl_vertex_shader",
+}
+
+// SupportedCompileOptions returns the compile option keys the embedded
+// module reads, for validating RawCompileOptions; any other key is
+// silently ignored. The module cannot be queried for them, so this is a
+// list maintained alongside wasm_out.
+func SupportedCompileOptions() []string {
+	return append([]string(nil), supportedCompileOptions...)
+}
+
+// compileOptions returns the compile_options object sent to the module.
+func (o TranslateOptions) compileOptions() map[string]bool {
+	options := map[string]bool{"object_code": !o.SkipObjectCode}
+	for key, enabled := range o.RawCompileOptions {
+		options[key] = enabled
+	}
+	return options
+}
+
+// applyExtensions returns source with the #extension directives requested
+// in extensions, in name order.
+func applyExtensions(source string, extensions map[string]ExtensionBehavior) string {
+	names := make([]string, 0, len(extensions))
+	for name := range extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	directives := make([]string, len(names))
+	for i, name := range names {
+		directives[i] = "#extension " + name + " : " + string(extensions[name])
+	}
+	return insertAfterVersion(source, directives)
+}
+
+// specLevels gives the ESSL version each spec accepts at most.
+var specLevels = map[ShaderSpec]int{
+	ShaderSpecGLES2: 100, ShaderSpecGLES3: 300, ShaderSpecGLES31: 310, ShaderSpecGLES32: 320,
+	ShaderSpecWebGL: 100, ShaderSpecWebGLN: 100, ShaderSpecWebGL2: 300, ShaderSpecWebGL3: 310,
+}
+
+// cappedSpec returns the spec to translate with when the context version is
+// limited to limit: spec itself, or the spec of spec's family at the level
+// of limit when that is lower.
+func cappedSpec(spec, limit ShaderSpec) (ShaderSpec, error) {
+	if limit == "" {
+		return spec, nil
+	}
+	limitLevel, ok := specLevels[limit]
+	if !ok {
+		return "", classify(ErrValidation, fmt.Errorf("unknown MinGLVersion %q", limit))
+	}
+	if level, ok := specLevels[spec]; !ok || level <= limitLevel {
+		return spec, nil
+	}
+	webgl := strings.HasPrefix(string(spec), "webgl")
+	for candidate, level := range specLevels {
+		if level == limitLevel && strings.HasPrefix(string(candidate), "webgl") == webgl && candidate != ShaderSpecWebGLN {
+			return candidate, nil
+		}
+	}
+	return limit, nil
+}
+
+// applyDefines returns source with the #define directives requested in
+// defines, in name order.
+func applyDefines(source string, defines map[string]string) string {
+	names := make([]string, 0, len(defines))
+	for name := range defines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	directives := make([]string, len(names))
+	for i, name := range names {
+		directives[i] = strings.TrimSpace("#define " + name + " " + defines[name])
+	}
+	return insertAfterVersion(source, directives)
+}
+
+// applyMatrixLayout returns source with default block layout declarations
+// for the matrix layout.
+func applyMatrixLayout(source string, layout MatrixLayout) string {
+	version := versionNumber(source)
+	if layout == MatrixLayoutDefault || version < 300 {
+		return source
+	}
+	declarations := []string{"layout(" + string(layout) + ") uniform;"}
+	if version >= 310 {
+		declarations = append(declarations, "layout("+string(layout)+") buffer;")
+	}
+	return insertBeforeDeclarations(source, declarations)
+}
+
+// glslVersion returns the desktop GLSL version number of the output format,
+// or 0 for ESSL and the unversioned OutputFormatGLSL.
+func (o OutputFormat) glslVersion() int {
+	s := string(o)
+	if !strings.HasPrefix(s, "glsl") {
+		return 0
+	}
+	v, err := strconv.Atoi(s[len("glsl"):])
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// applyProfile rewrites the #version directive of code to name the profile.
+func applyProfile(code string, output OutputFormat, profile GLSLProfile) string {
+	if profile == GLSLProfileDefault || output.glslVersion() < 150 {
+		return code
+	}
+	start, end, ok := findVersionDirective(code)
+	if !ok {
+		return code
+	}
+	fields := strings.Fields(code[start:end])
+	if len(fields) < 2 {
+		return code
+	}
+	return code[:start] + "#version " + fields[1] + " " + string(profile) + code[end:]
+}
+
+// Versions accepted in a #version directive, by language.
+var (
+	esslVersions = map[int]bool{100: true, 300: true, 310: true, 320: true}
+	glslVersions = map[int]bool{
+		110: true, 120: true, 130: true, 140: true, 150: true, 330: true,
+		400: true, 410: true, 420: true, 430: true, 440: true, 450: true, 460: true,
+	}
+)
+
+// applyForceVersion replaces the #version directive of code with version and
+// returns a warning when the version does not suit the output.
+func applyForceVersion(code string, output OutputFormat, version int) (string, *Diagnostic) {
+	essl := output == OutputFormatESSL
+	generated := 100
+	if !essl {
+		generated = 110
+	}
+	var profile string
+	start, end, ok := findVersionDirective(code)
+	if ok {
+		fields := strings.Fields(code[start:end])
+		if len(fields) >= 2 {
+			if n, err := strconv.Atoi(fields[1]); err == nil {
+				generated = n
+			}
+		}
+		if len(fields) >= 3 && !essl {
+			profile = fields[2]
+		}
+	}
+
+	directive := "#version " + strconv.Itoa(version)
+	if essl && version >= 300 {
+		directive += " es"
+	} else if profile != "" && version >= 150 {
+		directive += " " + profile
+	}
+	if ok {
+		code = code[:start] + directive + code[end:]
+	} else {
+		code = directive + "\n" + code
+	}
+
+	var message string
+	switch {
+	case essl && !esslVersions[version]:
+		message = fmt.Sprintf("forced version %d is not a GLSL ES version", version)
+	case !essl && !glslVersions[version]:
+		message = fmt.Sprintf("forced version %d is not a GLSL version", version)
+	case version < generated:
+		message = fmt.Sprintf("forced version %d is older than version %d the code was generated for", version, generated)
+	default:
+		return code, nil
+	}
+	return code, &Diagnostic{Severity: SeverityWarning, Message: message}
+}
+
+// checkESSLVersion returns an error unless ESSL output for spec can be
+// pinned to version.
+func checkESSLVersion(version int, spec ShaderSpec, output OutputFormat, forceVersion int) error {
+	switch {
+	case output != OutputFormatESSL:
+		return classify(ErrValidation, fmt.Errorf("ESSLVersion requires ESSL output, not %q", output))
+	case forceVersion != 0:
+		return classify(ErrValidation, errors.New("ESSLVersion cannot be combined with ForceVersion"))
+	case !esslVersions[version]:
+		return classify(ErrValidation, fmt.Errorf("ESSLVersion %d is not a GLSL ES version", version))
+	}
+	if level, ok := specLevels[spec]; ok && version > level {
+		return classify(ErrValidation, fmt.Errorf("ESSLVersion %d is newer than spec %q allows", version, spec))
+	}
+	return nil
+}
+
+// pinESSLVersion replaces the #version directive of ESSL code with version,
+// adding one if there is none, or returns an error when the code was
+// generated for a version it cannot be run as.
+func pinESSLVersion(code string, version int) (string, error) {
+	generated := 100
+	start, end, found := findVersionDirective(code)
+	if found {
+		if fields := strings.Fields(code[start:end]); len(fields) >= 2 {
+			if n, err := strconv.Atoi(fields[1]); err == nil {
+				generated = n
+			}
+		}
+	}
+	switch {
+	case generated == version && found:
+		return code, nil
+	case generated == version:
+		// ANGLE omits the directive for ESSL 1.00
+	case generated == 100 || version == 100:
+		return "", classify(ErrValidation, fmt.Errorf("code generated for ESSL version %d cannot be emitted as version %d", generated, version))
+	case version < generated:
+		return "", classify(ErrValidation, fmt.Errorf("ESSLVersion %d is older than version %d the code was generated for", version, generated))
+	}
+	code, _ = applyForceVersion(code, OutputFormatESSL, version)
+	return code, nil
+}
+
+// addHeaderComment inserts header as // comment lines after the #version
+// directive of code, or at the top when there is none.
+func addHeaderComment(code, header string) string {
+	lines := strings.Split(strings.TrimSuffix(normalizeSource(header), "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight("// "+line, " ")
+	}
+	comment := strings.Join(lines, "\n") + "\n"
+	_, end, ok := findVersionDirective(code)
+	if !ok {
+		return comment + code
+	}
+	if end == len(code) {
+		return code + "\n" + comment
+	}
+	return code[:end+1] + comment + code[end+1:]
+}
+
+// globalDeclaration matches a single global variable declaration as ANGLE
+// prints it, capturing the qualifiers, the type and the declared name.
+var globalDeclaration = regexp.MustCompile(`^((?:layout\s*\([^)]*\)\s*)?(?:(?:uniform|in|out|attribute|varying|flat|smooth|noperspective|centroid|invariant)\s+)+)(\w+)(\s+(\w+)\s*(?:\[[^\]]*\]\s*)*;)`)
+
+// applyPrecision adds the precision of every known global variable to its
+// declaration in desktop GLSL code.
+func applyPrecision(code string, output OutputFormat, variables map[string]ShaderVariable) string {
+	if !strings.HasPrefix(string(output), "glsl") {
+		return code
+	}
+	asComment := output.glslVersion() < 130
+	precisions := make(map[string]string)
+	for _, v := range variables {
+		if q := precisionQualifier(v.Precision); q != "" {
+			precisions[v.MappedName] = q
+		}
+	}
+	lines := strings.Split(code, "\n")
+	for i, line := range lines {
+		m := globalDeclaration.FindStringSubmatchIndex(line)
+		if m == nil {
+			continue
+		}
+		q, ok := precisions[line[m[8]:m[9]]]
+		if !ok {
+			continue
+		}
+		if asComment {
+			lines[i] = line + " // " + q
+		} else {
+			lines[i] = line[:m[4]] + q + " " + line[m[4]:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// uniformDeclaration matches a default-block uniform declaration line,
+// capturing the declared name.
+var uniformDeclaration = regexp.MustCompile(`^\s*(?:layout\s*\([^)]*\)\s*)?uniform\s+(?:(?:lowp|mediump|highp)\s+)?\w+\s+(\w+)\s*(?:\[[^\]]*\]\s*)*;\s*$`)
+
+// removeUniforms deletes the declarations of the named unused uniforms from
+// s.Code and drops them from s.Variables and s.order.
+func (s *Shader) removeUniforms(names []string) error {
+	removed := make(map[string]bool)
+	for _, name := range names {
+		v, ok := s.Variables[name]
+		if !ok || v.Category != categoryUniforms {
+			continue
+		}
+		if v.StaticUse {
+			return classify(ErrValidation, fmt.Errorf("uniform %q is used by the shader and cannot be removed", name))
+		}
+		removed[v.MappedName] = true
+		delete(s.Variables, name)
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	s.order = slices.DeleteFunc(s.order, func(name string) bool {
+		_, ok := s.Variables[name]
+		return !ok
+	})
+	lines := strings.Split(s.Code, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if m := uniformDeclaration.FindStringSubmatch(line); m != nil && removed[m[1]] {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	s.Code = strings.Join(kept, "\n")
+	return nil
+}
@@ -0,0 +1,146 @@
+package goshadertranslator
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ShaderType is a pipeline stage, named as the translator's shaderType
+// argument names it.
+type ShaderType string
+
+// The shader types the module accepts.
+const (
+	ShaderTypeVertex      ShaderType = "vertex"
+	ShaderTypeTessControl ShaderType = "tess_control"
+	ShaderTypeTessEval    ShaderType = "tess_eval"
+	ShaderTypeGeometry    ShaderType = "geometry"
+	ShaderTypeFragment    ShaderType = "fragment"
+	ShaderTypeCompute     ShaderType = "compute"
+)
+
+// pipelineOrder lists the graphics stages in the order data flows through
+// them.
+var pipelineOrder = []ShaderType{
+	ShaderTypeVertex,
+	ShaderTypeTessControl,
+	ShaderTypeTessEval,
+	ShaderTypeGeometry,
+	ShaderTypeFragment,
+}
+
+// CheckPipeline checks that the stages of a program pipeline, each compiled
+// separately as for glCreateShaderProgramv, have matching interfaces, and
+// returns one message per mismatch; nil means they match. Each stage's
+// inputs are matched against the outputs of the closest earlier stage in
+// the map, by layout(location = N) when the input declares one and by name
+// otherwise, as GLES 3.1 section 7.4.1 requires of separable programs.
+// Messages look like `fragment input "uv" (location 1): no vertex output at
+// location 1` or `location 0: vertex output "color" has type 0x8B52,
+// fragment input "tint" has type 0x8B51`. The types are compared without the
+// per-vertex array dimension of tessellation and geometry inputs; the
+// interpolation qualifiers, which the module does not report, are not
+// compared. Compute shaders are ignored.
+func CheckPipeline(stages map[ShaderType]*Shader) []string {
+	var problems []string
+	var producerType ShaderType
+	var producer *Shader
+	for _, stage := range pipelineOrder {
+		consumer, ok := stages[stage]
+		if !ok || consumer == nil {
+			continue
+		}
+		if producer != nil {
+			problems = append(problems, checkStageInterface(producerType, producer, stage, consumer)...)
+		}
+		producerType, producer = stage, consumer
+	}
+	return problems
+}
+
+// checkStageInterface matches the inputs of consumer against the outputs of
+// producer.
+func checkStageInterface(producerType ShaderType, producer *Shader, consumerType ShaderType, consumer *Shader) []string {
+	byLocation := make(map[int]ShaderVariable)
+	byName := make(map[string]ShaderVariable)
+	for _, v := range producer.stageVariables(categoryOutputVaryings) {
+		if v.Location >= 0 {
+			byLocation[v.Location] = v
+		} else {
+			byName[v.Name] = v
+		}
+	}
+	// the inputs of these stages, and the outputs of a tessellation control
+	// shader, have an extra array dimension for the vertices of a patch or
+	// primitive
+	perVertexIn := consumerType != ShaderTypeFragment
+	perVertexOut := producerType == ShaderTypeTessControl
+
+	var problems []string
+	for _, in := range consumer.stageVariables(categoryInputVaryings) {
+		var out ShaderVariable
+		var found bool
+		where := fmt.Sprintf("%s input %q", consumerType, in.Name)
+		if in.Location >= 0 {
+			where += fmt.Sprintf(" (location %d)", in.Location)
+			if out, found = byLocation[in.Location]; !found {
+				problems = append(problems, fmt.Sprintf("%s: no %s output at location %d", where, producerType, in.Location))
+				continue
+			}
+		} else if out, found = byName[in.Name]; !found {
+			problems = append(problems, fmt.Sprintf("%s: no %s output %q without a location", where, producerType, in.Name))
+			continue
+		}
+
+		inSizes, outSizes := in.ArraySizes, out.ArraySizes
+		if perVertexIn && len(inSizes) > 0 {
+			inSizes = inSizes[1:]
+		}
+		if perVertexOut && len(outSizes) > 0 {
+			outSizes = outSizes[1:]
+		}
+		if in.Type != out.Type || in.StructName != out.StructName || !slices.Equal(inSizes, outSizes) {
+			prefix := where
+			if in.Location >= 0 {
+				prefix = fmt.Sprintf("location %d", in.Location)
+			}
+			problems = append(problems, fmt.Sprintf("%s: %s output %q has type %s, %s input %q has type %s",
+				prefix, producerType, out.Name, typeDescription(out.Type, out.StructName, outSizes),
+				consumerType, in.Name, typeDescription(in.Type, in.StructName, inSizes)))
+		}
+	}
+	return problems
+}
+
+// stageVariables returns the user-declared variables of s in category,
+// sorted by location and then name.
+func (s *Shader) stageVariables(category string) []ShaderVariable {
+	var variables []ShaderVariable
+	for _, v := range s.Variables {
+		if v.Category == category && !strings.HasPrefix(v.Name, "gl_") {
+			variables = append(variables, v)
+		}
+	}
+	sort.Slice(variables, func(i, j int) bool {
+		if variables[i].Location != variables[j].Location {
+			return variables[i].Location < variables[j].Location
+		}
+		return variables[i].Name < variables[j].Name
+	})
+	return variables
+}
+
+// typeDescription formats a type as its GL enum, or its struct name, with
+// its array dimensions, as in "0x8B52[2]".
+func typeDescription(glType uint, structName string, arraySizes []uint) string {
+	desc := fmt.Sprintf("0x%04X", glType)
+	if structName != "" {
+		desc = structName
+	}
+	for _, size := range arraySizes {
+		desc += fmt.Sprintf("[%d]", size)
+	}
+	return desc
+}
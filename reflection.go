@@ -0,0 +1,368 @@
+package goshadertranslator
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SamplerInfo describes a sampler uniform.
+type SamplerInfo struct {
+	Name       string `json:"name"`
+	MappedName string `json:"mapped_name"`
+	Type       uint   `json:"type_enum"`
+	// Binding is the explicit layout(binding = N), or -1.
+	Binding    int    `json:"binding"`
+	ArraySizes []uint `json:"array_sizes,omitempty"`
+	StaticUse  bool   `json:"static_use"`
+	// Multisample is true for the sampler2DMS and sampler2DMSArray kinds
+	// (including their int and uint variants), which must be bound to a
+	// multisample texture and read with texelFetch.
+	Multisample bool `json:"multisample,omitempty"`
+}
+
+// ImageInfo describes an image uniform.
+type ImageInfo struct {
+	Name       string `json:"name"`
+	MappedName string `json:"mapped_name"`
+	Type       uint   `json:"type_enum"`
+	// Binding is the explicit layout(binding = N), or -1.
+	Binding          int              `json:"binding"`
+	ArraySizes       []uint           `json:"array_sizes,omitempty"`
+	StaticUse        bool             `json:"static_use"`
+	MemoryQualifiers MemoryQualifiers `json:"memory_qualifiers,omitempty"`
+}
+
+// Reflection groups the metadata of a translated shader by kind.
+type Reflection struct {
+	// Uniforms holds the default-block uniforms other than samplers and images.
+	Uniforms       []ShaderVariable `json:"uniforms"`
+	Attributes     []ShaderVariable `json:"attributes"`
+	InputVaryings  []ShaderVariable `json:"input_varyings"`
+	OutputVaryings []ShaderVariable `json:"output_varyings"`
+	// Outputs holds the fragment shader output variables.
+	Outputs          []ShaderVariable `json:"outputs"`
+	UniformBlocks    []InterfaceBlock `json:"uniform_blocks"`
+	StorageBlocks    []InterfaceBlock `json:"storage_blocks"`
+	Samplers         []SamplerInfo    `json:"samplers"`
+	Images           []ImageInfo      `json:"images"`
+	ComputeLocalSize [3]int           `json:"compute_local_size"`
+}
+
+// Reflect assembles the metadata already decoded into s into a single
+// Reflection. It does not consult the translator; every slice is derived
+// from Variables and Blocks. Attributes are in declaration order, as
+// returned by Attributes; the other slices, blocks included, are sorted by
+// name. With TranslateOptions.SortReflection the attributes are sorted by
+// name too.
+func (s *Shader) Reflect() Reflection {
+	r := Reflection{
+		Attributes:       s.Attributes(),
+		ComputeLocalSize: s.ComputeLocalSize,
+	}
+	for _, v := range s.sortedVariables() {
+		switch v.Category {
+		case categoryUniforms:
+			switch {
+			case glSamplerTypes[v.Type]:
+				r.Samplers = append(r.Samplers, SamplerInfo{
+					Name:        v.Name,
+					MappedName:  v.MappedName,
+					Type:        v.Type,
+					Binding:     v.Binding,
+					ArraySizes:  v.ArraySizes,
+					StaticUse:   v.StaticUse,
+					Multisample: glMultisampleSamplerTypes[v.Type],
+				})
+			case glImageTypes[v.Type]:
+				r.Images = append(r.Images, ImageInfo{
+					Name:             v.Name,
+					MappedName:       v.MappedName,
+					Type:             v.Type,
+					Binding:          v.Binding,
+					ArraySizes:       v.ArraySizes,
+					StaticUse:        v.StaticUse,
+					MemoryQualifiers: v.MemoryQualifiers,
+				})
+			default:
+				r.Uniforms = append(r.Uniforms, v)
+			}
+		case categoryInputVaryings:
+			r.InputVaryings = append(r.InputVaryings, v)
+		case categoryOutputVaryings:
+			r.OutputVaryings = append(r.OutputVaryings, v)
+		case categoryOutputVariables:
+			r.Outputs = append(r.Outputs, v)
+		}
+	}
+	for _, b := range s.Blocks {
+		switch b.Category {
+		case categoryUniformBlocks:
+			r.UniformBlocks = append(r.UniformBlocks, b)
+		case categoryStorageBlocks:
+			r.StorageBlocks = append(r.StorageBlocks, b)
+		}
+	}
+	if s.options.SortReflection {
+		sort.SliceStable(r.Attributes, func(i, j int) bool { return r.Attributes[i].Name < r.Attributes[j].Name })
+	}
+	return r
+}
+
+// declaredVariables returns the values of s.Variables in the order the
+// module reported them. Shaders without that order fall back to name order.
+func (s *Shader) declaredVariables() []ShaderVariable {
+	if len(s.order) == 0 {
+		return s.sortedVariables()
+	}
+	variables := make([]ShaderVariable, 0, len(s.Variables))
+	seen := make(map[string]bool, len(s.order))
+	for _, name := range s.order {
+		if v, ok := s.Variables[name]; ok && !seen[name] {
+			seen[name] = true
+			variables = append(variables, v)
+		}
+	}
+	return variables
+}
+
+// sortedVariables returns the values of s.Variables sorted by name.
+func (s *Shader) sortedVariables() []ShaderVariable {
+	variables := make([]ShaderVariable, 0, len(s.Variables))
+	for _, v := range s.Variables {
+		variables = append(variables, v)
+	}
+	sort.Slice(variables, func(i, j int) bool { return variables[i].Name < variables[j].Name })
+	return variables
+}
+
+// AttribDescriptor describes how to bind a vertex attribute with
+// glVertexAttribPointer (or glVertexAttribIPointer when Integer is set).
+type AttribDescriptor struct {
+	Name       string `json:"name"`
+	MappedName string `json:"mapped_name"`
+	// Location is the explicit layout location. Attributes without one are
+	// given, in declaration order, the lowest locations that fit them once
+	// the explicit ones are reserved, so holes below an explicit location
+	// are filled.
+	Location int `json:"location"`
+	// ComponentType is the GL enum of the components: GL_FLOAT, GL_INT,
+	// GL_UNSIGNED_INT or GL_BOOL.
+	ComponentType uint `json:"component_type"`
+	// ComponentCount is the number of components per location (the size
+	// argument of glVertexAttribPointer); a mat4 has 4 per column.
+	ComponentCount int `json:"component_count"`
+	// Integer is true for integer attributes, which need
+	// glVertexAttribIPointer.
+	Integer bool `json:"integer"`
+	// Normalized is a guess: true for float attributes whose name mentions
+	// a color, which are commonly fed from unsigned bytes.
+	Normalized bool `json:"normalized"`
+	// SlotCount is the number of consecutive locations the attribute spans.
+	SlotCount int `json:"slot_count"`
+}
+
+// VertexAttributeDescriptors returns bind-ready descriptors for the
+// attributes of a vertex shader, in declaration order.
+func (s *Shader) VertexAttributeDescriptors() []AttribDescriptor {
+	attributes := s.Attributes()
+	used := make(map[int]bool)
+	for _, v := range attributes {
+		if v.Location >= 0 {
+			for i := 0; i < v.SlotCount; i++ {
+				used[v.Location+i] = true
+			}
+		}
+	}
+
+	descriptors := make([]AttribDescriptor, 0, len(attributes))
+	for _, v := range attributes {
+		shape := glTypeShapes[v.Type]
+		location := v.Location
+		if location < 0 {
+			location = nextFreeLocation(used, 0, v.SlotCount)
+			for i := 0; i < v.SlotCount; i++ {
+				used[location+i] = true
+			}
+		}
+		lower := strings.ToLower(v.Name)
+		descriptors = append(descriptors, AttribDescriptor{
+			Name:           v.Name,
+			MappedName:     v.MappedName,
+			Location:       location,
+			ComponentType:  shape.component,
+			ComponentCount: shape.rows,
+			Integer:        shape.component == glInt || shape.component == glUnsignedInt,
+			Normalized: shape.component == glFloat &&
+				(strings.Contains(lower, "color") || strings.Contains(lower, "colour")),
+			SlotCount: v.SlotCount,
+		})
+	}
+	return descriptors
+}
+
+// FragmentOutputMapping maps each color output of a fragment shader to the
+// index of the color attachment, or glDrawBuffers entry, it writes: its
+// layout(location = N), or 0 for an output without one, which GLES only
+// allows as the sole output. An array output writes consecutive
+// attachments from that index. In ESSL 1.00, gl_FragColor maps to 0, as
+// does gl_FragData, whose element i writes attachment i. Other built-ins,
+// such as gl_FragDepth, are not color outputs and are left out, and the map
+// is empty for other shader types.
+func (s *Shader) FragmentOutputMapping() map[string]int {
+	mapping := make(map[string]int)
+	for _, v := range s.Variables {
+		if v.Category != categoryOutputVariables {
+			continue
+		}
+		if strings.HasPrefix(v.Name, "gl_") && v.Name != "gl_FragColor" && v.Name != "gl_FragData" {
+			continue
+		}
+		mapping[v.Name] = max(v.Location, 0)
+	}
+	return mapping
+}
+
+// nextFreeLocation returns the first location at or after start where span
+// consecutive locations are unused.
+func nextFreeLocation(used map[int]bool, start, span int) int {
+	for location := start; ; location++ {
+		free := true
+		for i := 0; i < span; i++ {
+			if used[location+i] {
+				free = false
+				break
+			}
+		}
+		if free {
+			return location
+		}
+	}
+}
+
+// bindingRange is the range of binding points an explicitly bound variable
+// or block occupies.
+type bindingRange struct {
+	name    string
+	binding int
+	count   int
+}
+
+// BindingConflicts reports explicit bindings that overlap within the same
+// binding space: texture units for samplers, image units for images, and
+// uniform and shader storage buffer bindings for blocks. Arrays occupy one
+// binding per element. Each message names the first binding point two
+// declarations share, such as `texture unit 0: "diffuse" and "normals"`;
+// nil means there is no conflict. Variables without an explicit binding are
+// not checked, since their bindings are assigned by the application.
+func (s *Shader) BindingConflicts() []string {
+	var samplers, images, uniformBlocks, storageBlocks []bindingRange
+	for _, v := range s.declaredVariables() {
+		if v.Category != categoryUniforms || v.Binding < 0 {
+			continue
+		}
+		r := bindingRange{name: v.Name, binding: v.Binding, count: arrayElementCount(v.ArraySizes)}
+		switch {
+		case glSamplerTypes[v.Type]:
+			samplers = append(samplers, r)
+		case glImageTypes[v.Type]:
+			images = append(images, r)
+		}
+	}
+	for _, b := range s.Blocks {
+		if b.Binding < 0 {
+			continue
+		}
+		r := bindingRange{name: b.Name, binding: b.Binding, count: 1}
+		if b.ArraySize > 0 {
+			r.count = int(b.ArraySize)
+		}
+		switch b.Category {
+		case categoryUniformBlocks:
+			uniformBlocks = append(uniformBlocks, r)
+		case categoryStorageBlocks:
+			storageBlocks = append(storageBlocks, r)
+		}
+	}
+
+	var conflicts []string
+	check := func(space string, ranges []bindingRange) {
+		owners := make(map[int]string)
+		for _, r := range ranges {
+			reported := make(map[string]bool)
+			for unit := r.binding; unit < r.binding+r.count; unit++ {
+				owner, taken := owners[unit]
+				if !taken {
+					owners[unit] = r.name
+				} else if !reported[owner] {
+					reported[owner] = true
+					conflicts = append(conflicts, fmt.Sprintf("%s %d: %q and %q", space, unit, owner, r.name))
+				}
+			}
+		}
+	}
+	check("texture unit", samplers)
+	check("image unit", images)
+	check("uniform buffer binding", uniformBlocks)
+	check("shader storage buffer binding", storageBlocks)
+	return conflicts
+}
+
+// assignBlockBindings gives every uniform and storage block without an
+// explicit binding the lowest free binding of its binding space, in
+// declaration order, and adds the binding to its layout qualifier in s.Code.
+// Explicit bindings from the source are kept and never reused.
+func (s *Shader) assignBlockBindings() {
+	used := map[string]map[int]bool{
+		categoryUniformBlocks: {},
+		categoryStorageBlocks: {},
+	}
+	type unbound struct {
+		block *InterfaceBlock
+		at    int // start of the declaration
+		end   int // end of the layout qualifier list
+	}
+	var blocks []unbound
+	for i := range s.Blocks {
+		b := &s.Blocks[i]
+		count := 1
+		if b.ArraySize > 0 {
+			count = int(b.ArraySize)
+		}
+		if b.Binding >= 0 {
+			for j := 0; j < count; j++ {
+				used[b.Category][b.Binding+j] = true
+			}
+			continue
+		}
+		declaration := regexp.MustCompile(`layout\s*\(([^)]*)\)\s*(?:uniform|buffer)\s+` + regexp.QuoteMeta(b.MappedName) + `\s*\{`)
+		if m := declaration.FindStringSubmatchIndex(s.Code); m != nil {
+			blocks = append(blocks, unbound{block: b, at: m[0], end: m[3]})
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].at < blocks[j].at })
+
+	next := map[string]int{}
+	bindings := make([]int, len(blocks))
+	for i, u := range blocks {
+		b := u.block
+		count := 1
+		if b.ArraySize > 0 {
+			count = int(b.ArraySize)
+		}
+		binding := nextFreeLocation(used[b.Category], next[b.Category], count)
+		for j := 0; j < count; j++ {
+			used[b.Category][binding+j] = true
+		}
+		next[b.Category] = binding + count
+		bindings[i] = binding
+	}
+	// rewrite from the end so earlier positions stay valid
+	for i := len(blocks) - 1; i >= 0; i-- {
+		blocks[i].block.Binding = bindings[i]
+		end := blocks[i].end
+		s.Code = s.Code[:end] + ", binding = " + strconv.Itoa(bindings[i]) + s.Code[end:]
+	}
+}
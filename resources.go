@@ -0,0 +1,374 @@
+package goshadertranslator
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Resources describes the limits of a target device. Field names follow
+// ANGLE's ShBuiltInResources. A zero field is treated as "no limit" by
+// FitsResources. Passed in TranslateOptions.Resources, only the limits the
+// embedded module applies are sent, and a zero one keeps the module's
+// default; the others are offline checks for FitsResources.
+type Resources struct {
+	// MaxVertexAttribs sets gl_MaxVertexAttribs and the highest attribute
+	// location ANGLE accepts. It is the one limit sent to the module.
+	MaxVertexAttribs int `json:"MaxVertexAttribs,omitempty"`
+
+	// The remaining limits are only checked by FitsResources.
+	MaxVertexUniformVectors      int `json:"-"`
+	MaxFragmentUniformVectors    int `json:"-"`
+	MaxVaryingVectors            int `json:"-"`
+	MaxVertexTextureImageUnits   int `json:"-"`
+	MaxTextureImageUnits         int `json:"-"`
+	MaxCombinedTextureImageUnits int `json:"-"`
+	// MaxDrawBuffers is the number of fragment outputs (gl_FragData
+	// elements, or output locations in ESSL 3.00).
+	MaxDrawBuffers int `json:"-"`
+	// MaxUniformBufferBindings is the number of uniform buffer binding
+	// points (GLES 3.0), checked against the number of uniform blocks.
+	MaxUniformBufferBindings int `json:"-"`
+
+	// MaxComputeWorkGroupSize limits each local_size dimension of a compute
+	// shader (GLES 3.1).
+	MaxComputeWorkGroupSize [3]int `json:"-"`
+	// MaxComputeWorkGroupInvocations limits the product of the local_size
+	// dimensions.
+	MaxComputeWorkGroupInvocations int `json:"-"`
+}
+
+// variableVectorCount returns the number of vec4 registers v occupies when
+// every scalar, vector and matrix column is given a register of its own.
+// Opaque types count as zero.
+func variableVectorCount(v ShaderVariable) int {
+	n := 0
+	if len(v.Fields) > 0 {
+		for _, field := range v.Fields {
+			n += variableVectorCount(field)
+		}
+	} else if shape, ok := glTypeShapes[v.Type]; ok {
+		n = shape.columns
+	}
+	return n * arrayElementCount(v.ArraySizes)
+}
+
+// UniformVectorCount returns the number of vec4 registers used by the active
+// default-block uniforms. Scalars and vectors are not packed together, so
+// this is an upper bound on what a driver that packs uniforms would count.
+func (s *Shader) UniformVectorCount() int {
+	n := 0
+	for _, v := range s.Variables {
+		if v.Category == categoryUniforms && v.Active {
+			n += variableVectorCount(v)
+		}
+	}
+	return n
+}
+
+// VaryingVectorCount returns the number of vec4 registers used by the
+// user-declared varyings the shader passes on to the next stage (vertex
+// shaders) or receives from the previous one (fragment shaders). Like
+// UniformVectorCount it does not pack.
+func (s *Shader) VaryingVectorCount() int {
+	category := categoryOutputVaryings
+	if s.shaderType == "fragment" {
+		category = categoryInputVaryings
+	}
+	n := 0
+	for _, v := range s.Variables {
+		if v.Category == category && !strings.HasPrefix(v.Name, "gl_") {
+			n += variableVectorCount(v)
+		}
+	}
+	return n
+}
+
+// EstimatedTempRegisters roughly estimates how many vec4 temporary registers
+// the shader needs, as a budgeting aid for GPUs with small register files.
+// ANGLE does no such analysis, so the estimate comes from Code: the largest
+// total, in any function, of the parameters and the locals in scope at
+// once, with each scalar, vector and matrix column taking a register, as in
+// UniformVectorCount; compile-time constants are left out. Registers freed
+// by the end of a block are reused, but not ones freed by a variable's last
+// use, and the temporaries a compiler needs for expressions and for nested
+// function calls are not counted, so it is only useful for comparing
+// shaders, not as a real register count.
+func (s *Shader) EstimatedTempRegisters() int {
+	tokens := tokenize(stripComments(s.Code))
+	structs := make(map[string]int)
+	var scopes []int
+	total, peak := 0, 0
+	for i := 0; i < len(tokens); i++ {
+		switch text := tokens[i].text; {
+		case text == "struct" && i+2 < len(tokens) && tokens[i+2].text == "{":
+			size := 0
+			j := i + 3
+			for ; j < len(tokens) && tokens[j].text != "}"; j++ {
+				if n, ok := declaredRegisters(tokens, j, structs); ok {
+					size += n
+				}
+			}
+			structs[tokens[i+1].text] = max(size, 1)
+			i = j
+		case text == "{" && len(scopes) == 0:
+			if i == 0 || tokens[i-1].text != ")" {
+				// a block or initializer at global scope: skip it
+				for depth := 0; i < len(tokens); i++ {
+					if tokens[i].text == "{" {
+						depth++
+					} else if tokens[i].text == "}" {
+						if depth--; depth == 0 {
+							break
+						}
+					}
+				}
+				continue
+			}
+			// a function body: count the parameters
+			params := 0
+			for j, depth := i-1, 0; j >= 0; j-- {
+				if tokens[j].text == ")" {
+					depth++
+				} else if tokens[j].text == "(" {
+					if depth--; depth == 0 {
+						break
+					}
+				} else if n, ok := declaredRegisters(tokens, j, structs); ok {
+					params += n
+				}
+			}
+			scopes = append(scopes, params)
+			total = params
+			peak = max(peak, total)
+		case text == "{":
+			scopes = append(scopes, 0)
+		case text == "}" && len(scopes) > 0:
+			total -= scopes[len(scopes)-1]
+			scopes = scopes[:len(scopes)-1]
+		case len(scopes) > 0:
+			if n, ok := declaredRegisters(tokens, i, structs); ok && !constDeclaration(tokens, i) {
+				scopes[len(scopes)-1] += n
+				total += n
+				peak = max(peak, total)
+			}
+		}
+	}
+	return peak
+}
+
+// declaredRegisters reports whether tokens[i] is the type of a variable or
+// parameter declaration and, if so, how many vec4 registers the variable
+// takes. Opaque types are not recognized.
+func declaredRegisters(tokens []token, i int, structs map[string]int) (int, bool) {
+	if i+2 >= len(tokens) || !isIdentStart(tokens[i+1].text[0]) || (i > 0 && tokens[i-1].text == ".") {
+		return 0, false
+	}
+	n, ok := structs[tokens[i].text]
+	if !ok {
+		n, ok = typeRegisterCount(tokens[i].text)
+	}
+	if !ok {
+		return 0, false
+	}
+	switch tokens[i+2].text {
+	case "=", ";", ",", ")":
+	case "[":
+		if i+4 < len(tokens) && tokens[i+4].text == "]" {
+			if size, err := strconv.Atoi(tokens[i+3].text); err == nil {
+				n *= size
+			}
+		}
+	default:
+		return 0, false
+	}
+	return n, true
+}
+
+// constDeclaration reports whether the declaration whose type is tokens[i]
+// is a compile-time constant, which needs no register of its own.
+func constDeclaration(tokens []token, i int) bool {
+	for j := i - 1; j >= 0; j-- {
+		switch tokens[j].text {
+		case "lowp", "mediump", "highp":
+			continue
+		case "const":
+			return true
+		}
+		break
+	}
+	return false
+}
+
+// typeRegisterCount returns the number of vec4 registers a variable of the
+// named scalar, vector or matrix type takes.
+func typeRegisterCount(name string) (int, bool) {
+	switch name {
+	case "float", "int", "uint", "bool":
+		return 1, true
+	}
+	if rest := strings.TrimLeft(name, "biu"); len(name)-len(rest) <= 1 && len(rest) == 4 && strings.HasPrefix(rest, "vec") {
+		return 1, rest[3] >= '2' && rest[3] <= '4'
+	}
+	if columns, ok := strings.CutPrefix(name, "mat"); ok && columns != "" && columns[0] >= '2' && columns[0] <= '4' {
+		if len(columns) == 1 || (len(columns) == 3 && columns[1] == 'x' && columns[2] >= '2' && columns[2] <= '4') {
+			return int(columns[0] - '0'), true
+		}
+	}
+	return 0, false
+}
+
+// SamplerCount returns the number of texture units the active sampler
+// uniforms need, counting every element of sampler arrays.
+func (s *Shader) SamplerCount() int {
+	n := 0
+	for _, v := range s.Variables {
+		if v.Category == categoryUniforms && v.Active && glSamplerTypes[v.Type] {
+			n += arrayElementCount(v.ArraySizes)
+		}
+	}
+	return n
+}
+
+// MaxTextureUnit returns the highest texture unit the active samplers use,
+// or -1 when there are none. Samplers with an explicit binding occupy it and,
+// for arrays, the units after it; the others are given, in declaration
+// order, the lowest free units that fit them, the way
+// VertexAttributeDescriptors assigns attribute locations, as an application
+// that numbers its units densely would.
+func (s *Shader) MaxTextureUnit() int {
+	var unbound []ShaderVariable
+	used := make(map[int]bool)
+	highest := -1
+	for _, v := range s.declaredVariables() {
+		if v.Category != categoryUniforms || !v.Active || !glSamplerTypes[v.Type] {
+			continue
+		}
+		if v.Binding < 0 {
+			unbound = append(unbound, v)
+			continue
+		}
+		count := arrayElementCount(v.ArraySizes)
+		for i := 0; i < count; i++ {
+			used[v.Binding+i] = true
+		}
+		highest = max(highest, v.Binding+count-1)
+	}
+	for _, v := range unbound {
+		count := arrayElementCount(v.ArraySizes)
+		unit := nextFreeLocation(used, 0, count)
+		for i := 0; i < count; i++ {
+			used[unit+i] = true
+		}
+		highest = max(highest, unit+count-1)
+	}
+	return highest
+}
+
+// UniformBlockCount returns the number of uniform buffer bindings the
+// uniform blocks need, one per block instance.
+func (s *Shader) UniformBlockCount() int {
+	n := 0
+	for _, b := range s.Blocks {
+		if b.Category != categoryUniformBlocks {
+			continue
+		}
+		if b.ArraySize > 0 {
+			n += int(b.ArraySize)
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// drawBufferCount returns the number of draw buffers the fragment outputs
+// need: one past the highest explicit or implied output location, or the
+// highest gl_FragData index written.
+func (s *Shader) drawBufferCount() int {
+	n := 0
+	for _, v := range s.Variables {
+		if v.Category != categoryOutputVariables {
+			continue
+		}
+		count := arrayElementCount(v.ArraySizes)
+		if v.Name == "gl_FragData" {
+			count = maxFragDataIndex(s.source) + 1
+		} else if strings.HasPrefix(v.Name, "gl_") {
+			continue
+		}
+		if v.Location > 0 {
+			count += v.Location
+		}
+		if count > n {
+			n = count
+		}
+	}
+	return n
+}
+
+// fragDataIndex matches a constant gl_FragData subscript.
+var fragDataIndex = regexp.MustCompile(`\bgl_FragData\s*\[\s*(\d+)\s*\]`)
+
+// maxFragDataIndex returns the highest constant gl_FragData index written
+// in source, or 0 when there is none.
+func maxFragDataIndex(source string) int {
+	highest := 0
+	for _, m := range fragDataIndex.FindAllStringSubmatch(stripComments(source), -1) {
+		if n, err := strconv.Atoi(m[1]); err == nil && n > highest {
+			highest = n
+		}
+	}
+	return highest
+}
+
+// FitsResources checks the shader against the limits in r and returns one
+// message per exceeded limit, or nil when it fits. The uniform and texture
+// unit limits that apply depend on the shader type, and compute shaders
+// have their ComputeLocalSize checked; limits of unknown stages are not
+// checked. Counts are unpacked upper bounds, so a violation means a shader
+// may be rejected, not that it certainly will be. Apart from
+// MaxVertexAttribs, the module never sees these limits (see Resources), so
+// this is the only place they are enforced.
+func (s *Shader) FitsResources(r Resources) []string {
+	var violations []string
+	check := func(what string, count, limit int, limitName string) {
+		if limit > 0 && count > limit {
+			violations = append(violations, fmt.Sprintf("%s: %d exceeds %s %d", what, count, limitName, limit))
+		}
+	}
+
+	uniforms := s.UniformVectorCount()
+	varyings := s.VaryingVectorCount()
+	samplers := s.SamplerCount()
+	switch s.shaderType {
+	case "vertex":
+		attributes := 0
+		for _, v := range s.Attributes() {
+			attributes += v.SlotCount
+		}
+		check("attribute locations", attributes, r.MaxVertexAttribs, "MaxVertexAttribs")
+		check("uniform vectors", uniforms, r.MaxVertexUniformVectors, "MaxVertexUniformVectors")
+		check("varying vectors", varyings, r.MaxVaryingVectors, "MaxVaryingVectors")
+		check("texture units", samplers, r.MaxVertexTextureImageUnits, "MaxVertexTextureImageUnits")
+	case "fragment":
+		check("uniform vectors", uniforms, r.MaxFragmentUniformVectors, "MaxFragmentUniformVectors")
+		check("varying vectors", varyings, r.MaxVaryingVectors, "MaxVaryingVectors")
+		check("texture units", samplers, r.MaxTextureImageUnits, "MaxTextureImageUnits")
+		check("draw buffers", s.drawBufferCount(), r.MaxDrawBuffers, "MaxDrawBuffers")
+	case "compute":
+		invocations := 1
+		for i, size := range s.ComputeLocalSize {
+			if size == 0 {
+				size = 1 // undeclared dimensions default to 1
+			}
+			check("work group size "+string("xyz"[i]), size, r.MaxComputeWorkGroupSize[i], fmt.Sprintf("MaxComputeWorkGroupSize[%d]", i))
+			invocations *= size
+		}
+		check("work group invocations", invocations, r.MaxComputeWorkGroupInvocations, "MaxComputeWorkGroupInvocations")
+	}
+	check("texture units", samplers, r.MaxCombinedTextureImageUnits, "MaxCombinedTextureImageUnits")
+	check("uniform blocks", s.UniformBlockCount(), r.MaxUniformBufferBindings, "MaxUniformBufferBindings")
+	return violations
+}
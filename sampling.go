@@ -0,0 +1,265 @@
+package goshadertranslator
+
+// ANGLE does not check where implicit-LOD texture lookups happen, so the
+// WarnNonUniformSampling check is a best-effort scan of the source. A lookup
+// is flagged when it sits in the body of an if, else, loop or switch whose
+// condition names anything besides uniforms, constants and the loop's own
+// counter. Lookups in functions called from such code, and in the branches
+// of ?:, are not found.
+
+// implicitLODFunctions lists the texture lookups that take their level of
+// detail from screen-space derivatives.
+var implicitLODFunctions = map[string]bool{
+	"texture": true, "textureOffset": true, "textureProj": true, "textureProjOffset": true,
+	"texture2D": true, "texture2DProj": true, "texture3D": true, "texture3DProj": true,
+	"textureCube": true,
+}
+
+// conditionKeywords lists the words a condition can contain that do not
+// make it non-uniform.
+var conditionKeywords = map[string]bool{
+	"true": true, "false": true, "int": true, "uint": true, "float": true, "bool": true,
+	"lowp": true, "mediump": true, "highp": true,
+}
+
+// token is a word or punctuation character of the source and its line.
+type token struct {
+	text string
+	line int
+}
+
+// tokenize splits code, with comments already removed, into tokens,
+// skipping preprocessor directives.
+func tokenize(code string) []token {
+	var tokens []token
+	line := 1
+	lineStart := true
+	for i := 0; i < len(code); {
+		c := code[i]
+		switch {
+		case c == '\n':
+			line++
+			lineStart = true
+			i++
+			continue
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+			continue
+		case c == '#' && lineStart:
+			for i < len(code) && code[i] != '\n' {
+				i++
+			}
+			continue
+		}
+		start := i
+		switch {
+		case isIdentStart(c):
+			for i < len(code) && isIdentChar(code[i]) {
+				i++
+			}
+		case c >= '0' && c <= '9':
+			for i < len(code) && (isIdentChar(code[i]) || code[i] == '.') {
+				i++
+			}
+		default:
+			i++
+		}
+		tokens = append(tokens, token{code[start:i], line})
+		lineStart = false
+	}
+	return tokens
+}
+
+// flowScanner walks the statements of function bodies, tracking whether
+// control flow may be non-uniform.
+type flowScanner struct {
+	tokens []token
+	pos    int
+	// uniform holds the names whose values are the same for every
+	// invocation
+	uniform map[string]bool
+	// report is false while a do-while body is skipped to reach its
+	// condition
+	report      bool
+	diagnostics []Diagnostic
+}
+
+func (p *flowScanner) peek(offset int) string {
+	if p.pos+offset < len(p.tokens) {
+		return p.tokens[p.pos+offset].text
+	}
+	return ""
+}
+
+func (p *flowScanner) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+// lookup records the token at pos when it starts an implicit-LOD lookup in
+// non-uniform control flow.
+func (p *flowScanner) lookup(nonUniform bool) {
+	t := p.tokens[p.pos]
+	if nonUniform && p.report && implicitLODFunctions[t.text] && p.peek(1) == "(" {
+		p.diagnostics = append(p.diagnostics, Diagnostic{
+			Severity: SeverityWarning,
+			Line:     t.line,
+			Token:    t.text,
+			Message:  "implicit-LOD texture lookup in non-uniform control flow has undefined derivatives",
+		})
+	}
+}
+
+// condition consumes the parenthesized condition at pos and reports
+// whether it is uniform. Names declared in it, such as a for loop's
+// counter, count as uniform.
+func (p *flowScanner) condition(nonUniform bool) bool {
+	if p.peek(0) != "(" {
+		return false
+	}
+	uniform := true
+	declared := make(map[string]bool)
+	depth := 0
+	for ; !p.done(); p.pos++ {
+		text := p.peek(0)
+		switch text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		}
+		if depth == 0 {
+			p.pos++
+			break
+		}
+		p.lookup(nonUniform)
+		if !isIdentStart(text[0]) || conditionKeywords[text] || p.peek(1) == "(" || p.tokens[p.pos-1].text == "." {
+			continue
+		}
+		if p.pos > 0 && conditionKeywords[p.tokens[p.pos-1].text] {
+			declared[text] = true
+		}
+		if !p.uniform[text] && !declared[text] {
+			uniform = false
+		}
+	}
+	return uniform
+}
+
+// statement consumes the statement at pos.
+func (p *flowScanner) statement(nonUniform bool) {
+	switch p.peek(0) {
+	case "{":
+		p.pos++
+		for !p.done() && p.peek(0) != "}" {
+			p.statement(nonUniform)
+		}
+		p.pos++
+	case "}":
+		// the end of an enclosing block, left for it to consume
+	case "if":
+		p.pos++
+		branch := nonUniform || !p.condition(nonUniform)
+		p.statement(branch)
+		if p.peek(0) == "else" {
+			p.pos++
+			p.statement(branch)
+		}
+	case "for", "while", "switch":
+		p.pos++
+		p.statement(nonUniform || !p.condition(nonUniform))
+	case "do":
+		p.pos++
+		body, report := p.pos, p.report
+		p.report = false
+		p.statement(nonUniform)
+		p.report = report
+		p.pos++ // while
+		uniform := p.condition(nonUniform)
+		if p.peek(0) == ";" {
+			p.pos++
+		}
+		end := p.pos
+		p.pos = body
+		p.statement(nonUniform || !uniform)
+		p.pos = end
+	default:
+		depth := 0
+		for ; !p.done(); p.pos++ {
+			switch p.peek(0) {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			case ";":
+				if depth == 0 {
+					p.pos++
+					return
+				}
+			case "{", "}":
+				if depth == 0 {
+					return
+				}
+			}
+			p.lookup(nonUniform)
+		}
+	}
+}
+
+// nonUniformSampling returns a warning for each implicit-LOD texture lookup
+// in non-uniform control flow in the function bodies of source. uniforms
+// holds the names of the shader's uniforms.
+func nonUniformSampling(source string, uniforms map[string]bool) []Diagnostic {
+	p := &flowScanner{tokens: tokenize(stripComments(source)), uniform: make(map[string]bool), report: true}
+	for name := range uniforms {
+		p.uniform[name] = true
+	}
+	for i, t := range p.tokens {
+		// const [precision] type name
+		if t.text == "const" {
+			for j := i + 1; j < len(p.tokens) && j <= i+3; j++ {
+				if next := p.tokens[j].text; j+1 < len(p.tokens) && p.tokens[j+1].text == "=" {
+					p.uniform[next] = true
+					break
+				}
+			}
+		}
+	}
+	depth := 0
+	for !p.done() {
+		switch p.peek(0) {
+		case "{":
+			if depth == 0 && p.pos > 0 && p.tokens[p.pos-1].text == ")" {
+				p.statement(false)
+				continue
+			}
+			depth++
+		case "}":
+			depth--
+		}
+		p.pos++
+	}
+	return p.diagnostics
+}
+
+// uniformNames returns the names that hold uniform values in s: its
+// default-block uniforms, and its uniform blocks' instance names or, for
+// blocks without one, their members.
+func (s *Shader) uniformNames() map[string]bool {
+	names := make(map[string]bool)
+	for _, v := range s.uniforms() {
+		names[v.Name] = true
+	}
+	for _, b := range s.Blocks {
+		if b.Category != categoryUniformBlocks {
+			continue
+		}
+		if b.InstanceName != "" {
+			names[b.InstanceName] = true
+			continue
+		}
+		for _, f := range b.Fields {
+			names[f.Name] = true
+		}
+	}
+	return names
+}
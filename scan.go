@@ -0,0 +1,305 @@
+package goshadertranslator
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// isIdentStart reports whether c can begin a GLSL identifier.
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isIdentChar reports whether c can appear inside a GLSL identifier.
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+// isIdentifier reports whether s is a GLSL identifier that is not reserved
+// for the implementation.
+func isIdentifier(s string) bool {
+	if s == "" || !isIdentStart(s[0]) || strings.HasPrefix(s, "gl_") || strings.Contains(s, "__") {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isIdentChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// forEachIdentifier calls fn for every identifier token in code, in order.
+// Numeric literals are skipped so suffixes like the "u" in "1u" are not
+// reported as identifiers.
+func forEachIdentifier(code string, fn func(ident string)) {
+	for i := 0; i < len(code); {
+		c := code[i]
+		switch {
+		case isIdentStart(c):
+			start := i
+			for i < len(code) && isIdentChar(code[i]) {
+				i++
+			}
+			fn(code[start:i])
+		case c >= '0' && c <= '9':
+			for i < len(code) && (isIdentChar(code[i]) || code[i] == '.') {
+				i++
+			}
+		default:
+			i++
+		}
+	}
+}
+
+// codeUsesAny reports whether any of the given identifiers appears in code.
+func codeUsesAny(code string, names ...string) bool {
+	found := false
+	forEachIdentifier(code, func(ident string) {
+		if found {
+			return
+		}
+		for _, name := range names {
+			if ident == name {
+				found = true
+				return
+			}
+		}
+	})
+	return found
+}
+
+// findVersionDirective returns the byte range of the #version line in code,
+// excluding its line terminator.
+func findVersionDirective(code string) (start, end int, ok bool) {
+	for start < len(code) {
+		end = strings.IndexByte(code[start:], '\n')
+		if end < 0 {
+			end = len(code)
+		} else {
+			end += start
+		}
+		line := strings.TrimSpace(code[start:end])
+		if strings.HasPrefix(line, "#") && strings.HasPrefix(strings.TrimSpace(line[1:]), "version") {
+			return start, end, true
+		}
+		start = end + 1
+	}
+	return 0, 0, false
+}
+
+// versionNumber returns the number of the #version directive in code, or
+// 100, the version GLSL ES assumes, when there is none.
+func versionNumber(code string) int {
+	start, end, ok := findVersionDirective(code)
+	if !ok {
+		return 100
+	}
+	fields := strings.Fields(strings.TrimSpace(code[start:end])[1:])
+	if len(fields) < 2 {
+		return 100
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 100
+	}
+	return n
+}
+
+// replaceIdentifiers returns code with every identifier token passed through
+// rename. Numeric literals and all other text are copied unchanged.
+func replaceIdentifiers(code string, rename func(ident string) string) string {
+	var b strings.Builder
+	b.Grow(len(code))
+	for i := 0; i < len(code); {
+		c := code[i]
+		start := i
+		switch {
+		case isIdentStart(c):
+			for i < len(code) && isIdentChar(code[i]) {
+				i++
+			}
+			b.WriteString(rename(code[start:i]))
+		case c >= '0' && c <= '9':
+			for i < len(code) && (isIdentChar(code[i]) || code[i] == '.') {
+				i++
+			}
+			b.WriteString(code[start:i])
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// stripComments returns code with every // and /* */ comment replaced by
+// spaces. Newlines are kept, so byte offsets and line numbers are unchanged.
+func stripComments(code string) string {
+	b := []byte(code)
+	for i := 0; i < len(b); i++ {
+		if b[i] != '/' || i+1 >= len(b) {
+			continue
+		}
+		switch b[i+1] {
+		case '/':
+			for ; i < len(b) && b[i] != '\n'; i++ {
+				b[i] = ' '
+			}
+		case '*':
+			b[i], b[i+1] = ' ', ' '
+			for i += 2; i < len(b); i++ {
+				if b[i] == '*' && i+1 < len(b) && b[i+1] == '/' {
+					b[i], b[i+1] = ' ', ' '
+					i++
+					break
+				}
+				if b[i] != '\n' {
+					b[i] = ' '
+				}
+			}
+		}
+	}
+	return string(b)
+}
+
+// insertAfterVersion inserts lines into source right after its #version
+// directive, or at the top when there is none. A #line directive follows
+// the inserted lines so the compiler still reports the original line
+// numbers for the rest of the source.
+func insertAfterVersion(source string, lines []string) string {
+	if len(lines) == 0 {
+		return source
+	}
+	inserted := strings.Join(lines, "\n")
+	start, end, ok := findVersionDirective(source)
+	if !ok {
+		return inserted + "\n#line 1\n" + source
+	}
+	next := strings.Count(source[:start], "\n") + 2
+	return source[:end] + "\n" + inserted + "\n#line " + strconv.Itoa(next) + source[end:]
+}
+
+// insertBeforeDeclarations inserts lines into source after its leading
+// #version, #extension, #pragma, #define, #undef and #line directives, i.e.
+// before the first declaration or conditional directive, since GLSL ES 3.00
+// requires #extension directives to precede every other token. A #line
+// directive follows the inserted lines so the compiler still reports the
+// original line numbers.
+func insertBeforeDeclarations(source string, lines []string) string {
+	if len(lines) == 0 {
+		return source
+	}
+	stripped := stripComments(source)
+	offset, lineNumber := 0, 1
+scan:
+	for offset < len(stripped) {
+		end := strings.IndexByte(stripped[offset:], '\n')
+		if end < 0 {
+			end = len(stripped)
+		} else {
+			end += offset
+		}
+		if line := strings.TrimSpace(stripped[offset:end]); line != "" {
+			if !strings.HasPrefix(line, "#") {
+				break
+			}
+			if fields := strings.Fields(line[1:]); len(fields) > 0 {
+				switch fields[0] {
+				case "version", "extension", "pragma", "define", "undef", "line":
+				default:
+					break scan // keep the lines out of conditionals
+				}
+			}
+		}
+		offset = end + 1
+		lineNumber++
+	}
+	inserted := strings.Join(lines, "\n")
+	if offset >= len(source) {
+		if source != "" && !strings.HasSuffix(source, "\n") {
+			source += "\n"
+		}
+		return source + inserted + "\n"
+	}
+	return source[:offset] + inserted + "\n#line " + strconv.Itoa(lineNumber) + "\n" + source[offset:]
+}
+
+// declarationPattern matches the declaration of name in translated code,
+// from the start of its line through the terminating semicolon.
+func declarationPattern(name string) *regexp.Regexp {
+	return regexp.MustCompile(`(?m)^[^;{}\n]*\b` + regexp.QuoteMeta(name) + `\s*(?:\[[^\]]*\]\s*)*;`)
+}
+
+// findBlockBody returns the byte range of the member list between the
+// braces of the uniform or buffer block named mappedName in translated code.
+func findBlockBody(code, mappedName string) (start, end int, ok bool) {
+	m := regexp.MustCompile(`\b(?:uniform|buffer)\s+` + regexp.QuoteMeta(mappedName) + `\s*\{([^}]*)\}`).FindStringSubmatchIndex(code)
+	if m == nil {
+		return 0, 0, false
+	}
+	return m[2], m[3], true
+}
+
+// parsePragmas returns the text of the #pragma directives in source.
+func parsePragmas(source string) []string {
+	var pragmas []string
+	for _, line := range strings.Split(stripComments(source), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#") {
+			continue
+		}
+		if text, ok := strings.CutPrefix(strings.TrimSpace(line[1:]), "pragma"); ok && (text == "" || text[0] == ' ' || text[0] == '\t') {
+			pragmas = append(pragmas, strings.TrimSpace(text))
+		}
+	}
+	return pragmas
+}
+
+// RequiredExtensions returns the extensions src requires, that is the names
+// of its "#extension name : require" directives, in the order they first
+// appear. An extension a later directive sets to another behavior, such as
+// disable, is not required. It only reads the directives, without running
+// the preprocessor, so directives inside #if blocks count whether or not
+// the block is compiled.
+func RequiredExtensions(src string) []string {
+	var names []string
+	required := make(map[string]bool)
+	for _, line := range strings.Split(stripComments(normalizeSource(src)), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#") {
+			continue
+		}
+		text, ok := strings.CutPrefix(strings.TrimSpace(line[1:]), "extension")
+		if !ok || text == "" || (text[0] != ' ' && text[0] != '\t') {
+			continue
+		}
+		name, behavior, ok := strings.Cut(text, ":")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if _, seen := required[name]; !seen {
+			names = append(names, name)
+		}
+		required[name] = strings.TrimSpace(behavior) == "require"
+	}
+	extensions := make([]string, 0, len(names))
+	for _, name := range names {
+		if required[name] {
+			extensions = append(extensions, name)
+		}
+	}
+	return extensions
+}
+
+// normalizeSource removes a leading UTF-8 byte order mark from source and
+// converts CRLF and CR line endings to LF.
+func normalizeSource(source string) string {
+	source = strings.TrimPrefix(source, "\uFEFF")
+	if !strings.Contains(source, "\r") {
+		return source
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(source, "\r\n", "\n"), "\r", "\n")
+}
@@ -1,7 +1,20 @@
 package goshadertranslator
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 type ShaderVariable struct {
-	Active     bool   `json:"active"`
+	Active bool `json:"active"`
+	// IsRowMajor is true for a row-major matrix member of a block,
+	// including a matrix nested in a row_major struct member. It is false
+	// for every variable that is not a matrix.
 	IsRowMajor bool   `json:"is_row_major"`
 	MappedName string `json:"mapped_name"`
 	Name       string `json:"name"`
@@ -9,42 +22,462 @@ type ShaderVariable struct {
 	StaticUse  bool   `json:"static_use"`
 	Type       uint   `json:"type_enum"`
 	Category   string `json:"category"`
+	// Binding is the explicit layout(binding = N) of a sampler, image or
+	// atomic counter, or -1 when the source does not declare one.
+	Binding int `json:"binding"`
+	// Location is the explicit layout(location = N), or -1 when the source
+	// does not declare one.
+	Location int `json:"location"`
+	// ArraySizes holds the array dimensions, outermost first; it is empty
+	// for non-arrays.
+	ArraySizes []uint `json:"array_sizes,omitempty"`
+	// SlotCount is the number of vertex attribute locations the variable
+	// consumes (one per matrix column, times the array size). It is only
+	// set for attributes.
+	SlotCount int `json:"slot_count,omitempty"`
+	// Offset is the byte offset of a std140 or std430 block member, relative
+	// to the start of the block, or of the enclosing struct for members of a
+	// struct. It is -1 for other variables.
+	Offset int `json:"offset"`
+	// ArrayStride is the byte distance between elements of an array member
+	// and MatrixStride the distance between the columns (rows, if
+	// IsRowMajor) of a matrix member of a std140 or std430 block.
+	ArrayStride  int `json:"array_stride,omitempty"`
+	MatrixStride int `json:"matrix_stride,omitempty"`
+	// MemoryQualifiers holds the readonly, writeonly, coherent, volatile and
+	// restrict qualifiers of an image uniform or a storage block member,
+	// including those inherited from the block.
+	MemoryQualifiers MemoryQualifiers `json:"memory_qualifiers,omitempty"`
+	// StructName is the name of the struct type for struct variables.
+	StructName string `json:"struct_name,omitempty"`
+	// Fields holds the members of a struct variable, in declaration order.
+	Fields []ShaderVariable `json:"fields,omitempty"`
+}
+
+// InterfaceBlock describes a uniform block or shader storage block.
+type InterfaceBlock struct {
+	Name         string `json:"name"`
+	MappedName   string `json:"mapped_name"`
+	InstanceName string `json:"instance_name,omitempty"`
+	ArraySize    uint   `json:"array_size,omitempty"`
+	// Layout is "std140", "std430", "shared" or "packed".
+	Layout string `json:"layout"`
+	// Binding is the explicit layout(binding = N), or -1.
+	Binding    int    `json:"binding"`
+	StaticUse  bool   `json:"static_use"`
+	Active     bool   `json:"active"`
+	IsRowMajor bool   `json:"is_row_major"`
+	Category   string `json:"category"`
+	// DataSize is the size in bytes of the block's data for the std140 and
+	// std430 layouts, or 0 when the layout is implementation defined.
+	DataSize int `json:"data_size,omitempty"`
+	// Fields holds the block members in declaration order, with struct
+	// members nested in their Fields.
+	Fields []ShaderVariable `json:"fields"`
 }
 
 type Shader struct {
 	Code      string                    `json:"code"`
 	Variables map[string]ShaderVariable `json:"variables,omitempty"`
+	// Blocks holds the uniform and shader storage blocks of the shader,
+	// sorted by name.
+	Blocks []InterfaceBlock `json:"blocks,omitempty"`
+
+	// UsesDerivatives is true when the translated code calls dFdx, dFdy or
+	// fwidth, meaning ESSL 1.00 targets need OES_standard_derivatives.
+	UsesDerivatives bool `json:"uses_derivatives"`
+	// UsesInstanceID and UsesVertexID report whether the translated code
+	// reads gl_InstanceID or gl_VertexID.
+	UsesInstanceID bool `json:"uses_instance_id"`
+	UsesVertexID   bool `json:"uses_vertex_id"`
+	// ComputeLocalSize is the declared work group size of a compute shader,
+	// or all zeros for other stages.
+	ComputeLocalSize [3]int `json:"compute_local_size"`
+	// EarlyFragmentTests is true when the fragment shader declares
+	// layout(early_fragment_tests) in; ANGLE keeps the declaration in Code.
+	EarlyFragmentTests bool `json:"early_fragment_tests,omitempty"`
+	// ShaderVersion is the GLSL ES version of the source: 100, 300, 310 or
+	// 320, independent of the output's #version. The module does not report
+	// it, so it is read from the source's #version directive, which ANGLE
+	// accepted; it is 0 for a Shader from ParseShaderResponse.
+	ShaderVersion int `json:"shader_version,omitempty"`
+	// Warnings is ANGLE's raw info log for the successful translation, which
+	// only ever holds warnings. It is empty when there were none.
+	Warnings string `json:"warnings,omitempty"`
+	// Diagnostics holds the warnings ANGLE reported for a successful
+	// translation.
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+	// DefaultPrecisions maps each type to its default precision at global
+	// scope ("float" -> "mediump"), combining the ESSL defaults for the
+	// shader type with the source's precision statements. A type without a
+	// default, such as float in an ESSL fragment shader that declares none,
+	// is absent.
+	DefaultPrecisions map[string]string `json:"default_precisions,omitempty"`
+	// Pragmas holds the text after "#pragma" of every pragma directive in
+	// the source, in source order, such as "optimize(off)" or a tool's own
+	// marker. ANGLE drops pragmas from Code, so they are read from the
+	// source; ones inside comments are ignored.
+	Pragmas []string `json:"pragmas,omitempty"`
+
+	// order holds the variable names in the order the module reported them,
+	// which is declaration order within each category, with the categories
+	// in name order
+	order []string
+
+	// the request that produced this shader, kept for RetranslateTo
+	source     string
+	shaderType string
+	spec       ShaderSpec
+	options    TranslateOptions
+	translator *ShaderTranslator
 }
 
-func newShader(response map[string]interface{}) *Shader {
-	fsResultPayload, _ := response["result"].(map[string]interface{})
+// Categories of active variables reported by the module.
+const (
+	categoryAttributes      = "attributes"
+	categoryInputVaryings   = "input_varyings"
+	categoryOutputVaryings  = "output_varyings"
+	categoryOutputVariables = "output_variables"
+	categoryUniforms        = "uniforms"
+	categoryUniformBlocks   = "uniform_blocks"
+	categoryStorageBlocks   = "shader_storage_buffer_blocks"
+	// categoryGenericBlocks repeats the uniform and storage blocks, so it
+	// is not decoded separately.
+	categoryGenericBlocks = "generic_interface_blocks"
+)
+
+// derivativeFunctions lists the builtins that compute screen-space derivatives.
+var derivativeFunctions = []string{
+	"dFdx", "dFdy", "fwidth",
+	"dFdxFine", "dFdyFine", "fwidthFine",
+	"dFdxCoarse", "dFdyCoarse", "fwidthCoarse",
+}
+
+func newShader(fsResultPayload map[string]interface{}) *Shader {
 	active_variables, _ := fsResultPayload["active_variables"].(map[string]interface{})
 
 	// iterate over the active variables and convert them to ShaderVariable
 	variables := make(map[string]ShaderVariable)
-	for name, varData := range active_variables {
-		// name is the category name, varData is the slice of variable data
-		for _, data := range varData.([]interface{}) {
+	var order []string
+	var blocks []InterfaceBlock
+	// visit the categories in name order so order is the same on every run
+	categories := make([]string, 0, len(active_variables))
+	for name := range active_variables {
+		categories = append(categories, name)
+	}
+	sort.Strings(categories)
+	for _, name := range categories {
+		// name is the category name, its value is the slice of variable data
+		list, _ := active_variables[name].([]interface{})
+		for _, data := range list {
 			variableMap, ok := data.(map[string]interface{})
 			if !ok {
 				continue // skip if the data is not a map
 			}
-			variable := ShaderVariable{
-				Active:     variableMap["active"].(bool),
-				IsRowMajor: variableMap["is_row_major"].(bool),
-				MappedName: variableMap["mapped_name"].(string),
-				Name:       variableMap["name"].(string),
-				Precision:  uint(variableMap["precision_enum"].(float64)),
-				StaticUse:  variableMap["static_use"].(bool),
-				Type:       uint(variableMap["type_enum"].(float64)),
-				Category:   name,
+			switch name {
+			case categoryGenericBlocks:
+			case categoryUniformBlocks, categoryStorageBlocks:
+				blocks = append(blocks, newInterfaceBlock(variableMap, name))
+			default:
+				variable := newShaderVariable(variableMap, name)
+				variables[variable.Name] = variable
+				order = append(order, variable.Name)
 			}
-			variables[variable.Name] = variable
 		}
 	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Name < blocks[j].Name })
 
+	code, _ := fsResultPayload["object_code"].(string)
+	infoLog, _ := fsResultPayload["info_log"].(string)
+	setMemoryQualifiers(code, variables, blocks)
 	return &Shader{
-		Code:      fsResultPayload["object_code"].(string),
-		Variables: variables,
+		Code:               code,
+		Variables:          variables,
+		Blocks:             blocks,
+		UsesDerivatives:    codeUsesAny(code, derivativeFunctions...),
+		UsesInstanceID:     codeUsesAny(code, "gl_InstanceID", "gl_InstanceIDEXT"),
+		UsesVertexID:       codeUsesAny(code, "gl_VertexID"),
+		ComputeLocalSize:   parseComputeLocalSize(code),
+		EarlyFragmentTests: earlyFragmentTestsDeclaration.MatchString(code),
+		Warnings:           infoLog,
+		Diagnostics:        parseDiagnostics(infoLog),
+		order:              order,
+	}
+}
+
+func newShaderVariable(variableMap map[string]interface{}, category string) ShaderVariable {
+	variable := ShaderVariable{
+		Active:     jsonBool(variableMap, "active"),
+		IsRowMajor: jsonBool(variableMap, "is_row_major"),
+		MappedName: jsonString(variableMap, "mapped_name"),
+		Name:       jsonString(variableMap, "name"),
+		Precision:  uint(jsonInt(variableMap, "precision_enum", 0)),
+		StaticUse:  jsonBool(variableMap, "static_use"),
+		Type:       uint(jsonInt(variableMap, "type_enum", 0)),
+		Category:   category,
+		Binding:    jsonInt(variableMap, "binding", -1),
+		Location:   jsonInt(variableMap, "location", -1),
+		Offset:     -1,
+		StructName: jsonString(variableMap, "struct_or_block_name"),
+	}
+	if sizes, ok := variableMap["array_sizes"].([]interface{}); ok {
+		for _, size := range sizes {
+			if n, ok := size.(float64); ok {
+				variable.ArraySizes = append(variable.ArraySizes, uint(n))
+			}
+		}
+	}
+	if category == categoryAttributes {
+		variable.SlotCount = attributeSlotCount(variable.Type, variable.ArraySizes)
+	}
+	if fields, ok := variableMap["fields"].([]interface{}); ok {
+		for _, field := range fields {
+			if fieldMap, ok := field.(map[string]interface{}); ok {
+				variable.Fields = append(variable.Fields, newShaderVariable(fieldMap, category))
+			}
+		}
+	}
+	return variable
+}
+
+func newInterfaceBlock(blockMap map[string]interface{}, category string) InterfaceBlock {
+	block := InterfaceBlock{
+		Name:         jsonString(blockMap, "name"),
+		MappedName:   jsonString(blockMap, "mapped_name"),
+		InstanceName: jsonString(blockMap, "instance_name"),
+		ArraySize:    uint(jsonInt(blockMap, "array_size", 0)),
+		Layout:       jsonString(blockMap, "layout"),
+		Binding:      jsonInt(blockMap, "binding", -1),
+		StaticUse:    jsonBool(blockMap, "static_use"),
+		Active:       jsonBool(blockMap, "active"),
+		IsRowMajor:   jsonBool(blockMap, "is_row_major_layout"),
+		Category:     category,
+	}
+	if fields, ok := blockMap["fields"].([]interface{}); ok {
+		for _, field := range fields {
+			if fieldMap, ok := field.(map[string]interface{}); ok {
+				block.Fields = append(block.Fields, newShaderVariable(fieldMap, category))
+			}
+		}
+	}
+	for i := range block.Fields {
+		setMatrixLayout(&block.Fields[i], false)
+	}
+	layoutBlock(&block)
+	return block
+}
+
+func jsonBool(m map[string]interface{}, key string) bool {
+	v, _ := m[key].(bool)
+	return v
+}
+
+func jsonString(m map[string]interface{}, key string) string {
+	v, _ := m[key].(string)
+	return v
+}
+
+// jsonInt returns the numeric value of key, or def when it is missing.
+func jsonInt(m map[string]interface{}, key string, def int) int {
+	if v, ok := m[key].(float64); ok {
+		return int(v)
+	}
+	return def
+}
+
+// localSizeDeclaration matches the work group size layout ANGLE emits for
+// compute shaders.
+var localSizeDeclaration = regexp.MustCompile(`layout\s*\(([^)]*local_size_[xyz][^)]*)\)\s*in\s*;`)
+
+// earlyFragmentTestsDeclaration matches the early fragment tests layout.
+var earlyFragmentTestsDeclaration = regexp.MustCompile(`layout\s*\(\s*early_fragment_tests\s*\)\s*in\s*;`)
+
+// parseComputeLocalSize extracts the local_size_x/y/z values from code.
+func parseComputeLocalSize(code string) [3]int {
+	var size [3]int
+	m := localSizeDeclaration.FindStringSubmatch(code)
+	if m == nil {
+		return size
+	}
+	for _, qualifier := range strings.Split(m[1], ",") {
+		key, value, ok := strings.Cut(qualifier, "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "local_size_x":
+			size[0] = n
+		case "local_size_y":
+			size[1] = n
+		case "local_size_z":
+			size[2] = n
+		}
+	}
+	return size
+}
+
+// precisionStatement matches a default precision declaration such as
+// "precision mediump float;".
+var precisionStatement = regexp.MustCompile(`\bprecision\s+(lowp|mediump|highp)\s+(\w+)\s*;`)
+
+// parseDefaultPrecisions returns the default precision of each type at
+// global scope in an ESSL source: the language defaults for the shader type,
+// overridden by the source's global precision statements.
+func parseDefaultPrecisions(source, shaderType string) map[string]string {
+	precisions := map[string]string{
+		"sampler2D":   "lowp",
+		"samplerCube": "lowp",
+	}
+	if shaderType == "fragment" {
+		precisions["int"] = "mediump"
+	} else {
+		precisions["float"] = "highp"
+		precisions["int"] = "highp"
+	}
+	code := stripComments(source)
+	depth, scanned := 0, 0
+	for _, m := range precisionStatement.FindAllStringSubmatchIndex(code, -1) {
+		depth += strings.Count(code[scanned:m[0]], "{") - strings.Count(code[scanned:m[0]], "}")
+		scanned = m[0]
+		if depth == 0 {
+			precisions[code[m[4]:m[5]]] = code[m[2]:m[3]]
+		}
+	}
+	return precisions
+}
+
+// Attributes returns the user-declared vertex attributes of the shader in
+// source declaration order, so locations assigned by position are stable
+// across runs. Built-in inputs such as gl_VertexID are omitted because they
+// do not occupy attribute locations.
+func (s *Shader) Attributes() []ShaderVariable {
+	var attributes []ShaderVariable
+	for _, v := range s.declaredVariables() {
+		if v.Category == categoryAttributes && !strings.HasPrefix(v.Name, "gl_") {
+			attributes = append(attributes, v)
+		}
+	}
+	return attributes
+}
+
+// ActiveUniforms returns the default-block uniforms the shader actually
+// uses, those both Active and StaticUse, in the order the module reports
+// them, which is the same for every translation of a source. They are the
+// uniforms an application needs to set; samplers are included.
+func (s *Shader) ActiveUniforms() []ShaderVariable {
+	var uniforms []ShaderVariable
+	for _, v := range s.declaredVariables() {
+		if v.Category == categoryUniforms && v.Active && v.StaticUse {
+			uniforms = append(uniforms, v)
+		}
+	}
+	return uniforms
+}
+
+// Categories returns the distinct Category values of the shader's Variables
+// and Blocks, sorted. They are the module's category names, such as
+// "attributes", "uniforms" or "uniform_blocks", for tools that group the
+// variables generically.
+func (s *Shader) Categories() []string {
+	seen := make(map[string]bool)
+	for _, v := range s.Variables {
+		seen[v.Category] = true
+	}
+	for _, b := range s.Blocks {
+		seen[b.Category] = true
+	}
+	categories := make([]string, 0, len(seen))
+	for category := range seen {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// UsedBuiltins returns the gl_ built-in variables the translated shader
+// references, sorted by name. It combines a scan of Code with the built-ins
+// ANGLE reports as variables, so built-ins the output renames (such as
+// gl_FragColor becoming webgl_FragColor in desktop GLSL) are still listed.
+func (s *Shader) UsedBuiltins() []string {
+	used := make(map[string]bool)
+	forEachIdentifier(s.Code, func(ident string) {
+		if strings.HasPrefix(ident, "gl_") {
+			used[ident] = true
+		}
+	})
+	for name, v := range s.Variables {
+		if strings.HasPrefix(name, "gl_") && v.StaticUse {
+			used[name] = true
+		}
+	}
+	builtins := make([]string, 0, len(used))
+	for name := range used {
+		builtins = append(builtins, name)
+	}
+	sort.Strings(builtins)
+	return builtins
+}
+
+// EntryPoints returns the names of the entry points in Code. The ESSL and
+// GLSL backends, the only ones the embedded module includes, neither rename
+// main nor allow a second entry point, so this is always ["main"].
+func (s *Shader) EntryPoints() []string {
+	return []string{"main"}
+}
+
+// OutputVersion parses the #version directive of Code: the version number,
+// whether it is a GLSL ES version ("#version 300 es") and the desktop
+// profile it names, such as "core" or "compatibility", or "" when it names
+// none. It returns 0, false and "" when Code has no directive, as in ESSL
+// 1.00 output.
+func (s *Shader) OutputVersion() (version int, es bool, profile string) {
+	start, end, ok := findVersionDirective(s.Code)
+	if !ok {
+		return 0, false, ""
+	}
+	fields := strings.Fields(strings.TrimSpace(s.Code[start:end])[1:])
+	if len(fields) < 2 {
+		return 0, false, ""
+	}
+	version, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, false, ""
+	}
+	if len(fields) >= 3 {
+		if fields[2] == "es" {
+			es = true
+		} else {
+			profile = fields[2]
+		}
+	}
+	return version, es, profile
+}
+
+// SourceCode returns the shader source that was translated to produce s.
+func (s *Shader) SourceCode() string {
+	return s.source
+}
+
+// CodeHash returns the SHA-256 of Code as lowercase hex, for keying GPU
+// pipeline caches. Only the code is hashed, not the reflection metadata, so
+// it changes exactly when the code handed to the driver does. Translating
+// the same source with the same module, spec, output and options gives
+// the same hash.
+func (s *Shader) CodeHash() string {
+	sum := sha256.Sum256([]byte(s.Code))
+	return hex.EncodeToString(sum[:])
+}
+
+// RetranslateTo translates the original source of s again, with the same
+// shader type, spec and options, to a different output format. It uses the
+// translator that produced s, which must still be open.
+func (s *Shader) RetranslateTo(output OutputFormat) (*Shader, error) {
+	if s.translator == nil {
+		return nil, fmt.Errorf("shader was not produced by a translator")
 	}
+	return s.translator.TranslateShaderWithOptions(s.source, s.shaderType, s.spec, output, s.options)
 }
@@ -0,0 +1,81 @@
+package goshadertranslator
+
+import (
+	"context"
+	"sync"
+)
+
+// TranslateRequest is one translation for TranslateStream, with the
+// arguments of TranslateShaderWithOptions.
+type TranslateRequest struct {
+	Source     string
+	ShaderType string
+	Spec       ShaderSpec
+	Output     OutputFormat
+	Options    TranslateOptions
+}
+
+// TranslateResult is the outcome of a TranslateRequest: the Shader on
+// success, or the error.
+type TranslateResult struct {
+	Request TranslateRequest
+	Shader  *Shader
+	Err     error
+}
+
+// TranslateStream translates the requests received from in on a pool of
+// workers translators, created with opts, and sends one result per request
+// to the returned channel. Results arrive in completion order, not request
+// order; each carries its request for matching. The channel is closed, and
+// the translators with it, once in is closed and drained or ctx is done.
+// After ctx is done no further requests are read and pending results are
+// dropped; a translation already running finishes first. A worker whose
+// translator cannot be created reports that error for each request it
+// receives. workers below 1 means 1. Since the translators are closed when
+// the stream ends, RetranslateTo fails on the shaders it produced.
+func TranslateStream(ctx context.Context, in <-chan TranslateRequest, workers int, opts ...TranslatorOption) <-chan TranslateResult {
+	if workers < 1 {
+		workers = 1
+	}
+	out := make(chan TranslateResult)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			st, err := NewShaderTranslator(context.WithoutCancel(ctx), opts...)
+			if err == nil {
+				defer st.Close()
+			}
+			for {
+				var req TranslateRequest
+				var ok bool
+				select {
+				case <-ctx.Done():
+					return
+				case req, ok = <-in:
+					if !ok {
+						return
+					}
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				result := TranslateResult{Request: req, Err: err}
+				if err == nil {
+					result.Shader, result.Err = st.TranslateShaderWithOptions(req.Source, req.ShaderType, req.Spec, req.Output, req.Options)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case out <- result:
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
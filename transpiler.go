@@ -1,11 +1,16 @@
 package goshadertranslator
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	_ "embed"
 
@@ -14,6 +19,13 @@ import (
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 )
 
+// ShaderSpec selects the language rules the source is checked against. The
+// WebGL specs add WebGL's restrictions to those of the GLES version they
+// are based on, and ANGLE enforces them itself with compile errors: for
+// example, identifiers starting with "webgl_" or "_webgl_" are rejected
+// under ShaderSpecWebGL2 but accepted under ShaderSpecGLES3. Translating
+// under the WebGL spec a shader will run under therefore catches shaders
+// that only work natively.
 type ShaderSpec string
 
 const (
@@ -47,19 +59,63 @@ const (
 //go:embed wasm_out/angle_shader_translator_standalone.wasm
 var wasmByteCode []byte
 
+// compilationCache is shared by every runtime this package creates, so the
+// embedded module is only compiled to machine code once per process.
+var compilationCache = wazero.NewCompilationCache()
+
+// firstCompile makes the first compilation of the module for each engine
+// happen once, while concurrent first callers wait for it and then find the
+// machine code in compilationCache instead of compiling it again.
+var firstCompile [EngineInterpreter + 1]sync.Once
+
+// compileModule compiles the embedded module for r. It is a variable so
+// tests can observe every compilation.
+var compileModule = func(ctx context.Context, r wazero.Runtime) (wazero.CompiledModule, error) {
+	return r.CompileModule(ctx, wasmByteCode)
+}
+
+// getCompiledModule compiles the embedded module for r. A CompiledModule
+// belongs to the runtime that compiled it, so every call compiles the
+// module again. The first call per engine runs alone; the others wait for
+// it and then call r.CompileModule themselves, which is cheap because the
+// machine code is in compilationCache by then. The interpreter does not
+// use the cache, but compiling for it is quick anyway.
+func getCompiledModule(ctx context.Context, r wazero.Runtime, engine Engine) (wazero.CompiledModule, error) {
+	var compiled wazero.CompiledModule
+	var err error
+	first := false
+	firstCompile[engine].Do(func() {
+		compiled, err = compileModule(ctx, r)
+		first = true
+	})
+	if first {
+		return compiled, err
+	}
+	return compileModule(ctx, r)
+}
+
 // ShaderTranslator wraps the wazero runtime and ANGLE WASM module.
 type ShaderTranslator struct {
 	runtime     wazero.Runtime
+	borrowed    bool // the runtime belongs to the caller; Close only closes the module
 	module      api.Module
 	ctx         context.Context
+	mu          sync.Mutex // serializes Close with translations
 	closed      bool
+	stop        chan struct{}
 	initializer api.Function
 	finalizer   api.Function
 	invoker     api.Function
 	malloc      api.Function
 	free        api.Function
+	config      TranslatorConfig
+	peakMemory  uint64
+	lastID      int
 }
 
+// TranslateRequestParams is the params object of a "translate" request.
+// The module's protocol only accepts shader source as base64 in
+// ShaderCodeBase64, so there is no raw-source field.
 type TranslateRequestParams struct {
 	ShaderCodeBase64     string          `json:"shader_code_base64"`
 	ShaderType           string          `json:"shader_type"`
@@ -67,6 +123,7 @@ type TranslateRequestParams struct {
 	Output               OutputFormat    `json:"output"`
 	PrintActiveVariables bool            `json:"print_active_variables"`
 	CompileOptions       map[string]bool `json:"compile_options"`
+	Resources            *Resources      `json:"resources,omitempty"`
 }
 
 type JSONRPCRequest struct {
@@ -76,27 +133,118 @@ type JSONRPCRequest struct {
 	Params  TranslateRequestParams `json:"params"`
 }
 
+// jsonRPCResponse is a response of the module. The result is decoded by
+// newShader.
+type jsonRPCResponse struct {
+	JsonRPC string                 `json:"jsonrpc"`
+	ID      interface{}            `json:"id"`
+	Result  map[string]interface{} `json:"result"`
+	Error   *jsonRPCError          `json:"error"`
+}
+
+// jsonRPCError is the error member of a failed response.
+type jsonRPCError struct {
+	Code    int        `json:"code"`
+	Message string     `json:"message"`
+	Data    *errorData `json:"data"`
+}
+
+// errorData is the data the module attaches to an error. Only compile
+// failures carry it; other errors have no data member.
+type errorData struct {
+	InfoLog string `json:"info_log"`
+}
+
 // NewShaderTranslator initializes the wazero runtime, loads the WASM module,
-// and prepares it for use.
-func NewShaderTranslator(ctx context.Context) (*ShaderTranslator, error) {
-	r := wazero.NewRuntime(ctx)
+// and prepares it for use. Options adjust the translator's TranslatorConfig.
+func NewShaderTranslator(ctx context.Context, opts ...TranslatorOption) (*ShaderTranslator, error) {
+	config := newTranslatorConfig(opts)
+	if config.Engine < EngineAuto || config.Engine > EngineInterpreter {
+		return nil, classify(ErrRuntime, fmt.Errorf("unknown engine %v", config.Engine))
+	}
+	r, err := newRuntime(ctx, config)
+	if err != nil {
+		return nil, err
+	}
 
 	// we'll need to instantiate WASI because the WASM module was
 	// compiled with dependencies on it (e.g., for libc functions).
 	wasi_snapshot_preview1.MustInstantiate(ctx, r)
 
-	compiledModule, err := r.CompileModule(ctx, wasmByteCode)
+	compiledModule, err := getCompiledModule(ctx, r, config.Engine)
+	if err != nil {
+		r.Close(ctx)
+		return nil, classify(ErrRuntime, fmt.Errorf("failed to compile wasm module: %w", err))
+	}
+
+	st, err := instantiateTranslator(ctx, r, compiledModule, config)
 	if err != nil {
 		r.Close(ctx)
-		return nil, fmt.Errorf("failed to compile wasm module: %w", err)
+		return nil, err
+	}
+	return st, nil
+}
+
+// newRuntime creates the runtime for config. wazero panics when the
+// compiler is requested on a platform it does not support; the panic is
+// returned as an ErrRuntime error instead.
+func newRuntime(ctx context.Context, config TranslatorConfig) (r wazero.Runtime, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = classify(ErrRuntime, fmt.Errorf("failed to create wazero runtime: %v", p))
+		}
+	}()
+	return wazero.NewRuntimeWithConfig(ctx, config.runtimeConfig()), nil
+}
+
+// requiredExports lists the functions the translator calls in the module.
+var requiredExports = []string{"initialize", "finalize", "invoke", "malloc", "free"}
+
+// NewShaderTranslatorFromCompiled creates a translator from cm, a module the
+// caller compiled in its own runtime r, such as EmbeddedModule compiled with
+// r.CompileModule, so one runtime can be shared with other wazero-based
+// libraries. r must have WASI (wasi_snapshot_preview1) instantiated, or not
+// have a module of that name, in which case it is instantiated here. Each
+// translator instantiates cm under TranslatorConfig.ModuleName, so several
+// translators in one runtime need WithModuleName to tell them apart. Close
+// closes only the module instance and leaves r to the caller; options that
+// configure the runtime, such as WithCompiler, have no effect.
+func NewShaderTranslatorFromCompiled(ctx context.Context, r wazero.Runtime, cm wazero.CompiledModule, opts ...TranslatorOption) (*ShaderTranslator, error) {
+	config := newTranslatorConfig(opts)
+	exports := cm.ExportedFunctions()
+	for _, name := range requiredExports {
+		if _, ok := exports[name]; !ok {
+			return nil, classify(ErrRuntime, fmt.Errorf("compiled module does not export %q", name))
+		}
+	}
+	if r.Module(wasi_snapshot_preview1.ModuleName) == nil {
+		if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+			return nil, classify(ErrRuntime, fmt.Errorf("failed to instantiate WASI: %w", err))
+		}
 	}
+	st, err := instantiateTranslator(ctx, r, cm, config)
+	if err != nil {
+		return nil, err
+	}
+	st.borrowed = true
+	return st, nil
+}
+
+// EmbeddedModule returns a copy of the WASM binary of the ANGLE translator
+// embedded in this package, for compiling it in a caller's runtime.
+func EmbeddedModule() []byte {
+	return slices.Clone(wasmByteCode)
+}
 
-	moduleConfig := wazero.NewModuleConfig().WithStartFunctions()
+// instantiateTranslator instantiates compiledModule in r and initializes
+// the ANGLE library. On failure the module instance, if any, is closed, but
+// r is left to the caller.
+func instantiateTranslator(ctx context.Context, r wazero.Runtime, compiledModule wazero.CompiledModule, config TranslatorConfig) (*ShaderTranslator, error) {
+	moduleConfig := wazero.NewModuleConfig().WithStartFunctions().WithName(config.ModuleName)
 
 	module, err := r.InstantiateModule(ctx, compiledModule, moduleConfig)
 	if err != nil {
-		r.Close(ctx)
-		return nil, fmt.Errorf("failed to instantiate wasm module: %w", err)
+		return nil, classify(ErrRuntime, fmt.Errorf("failed to instantiate wasm module: %w", err))
 	}
 
 	initializer := module.ExportedFunction("initialize")
@@ -106,18 +254,18 @@ func NewShaderTranslator(ctx context.Context) (*ShaderTranslator, error) {
 	free := module.ExportedFunction("free")
 
 	if invoker == nil || malloc == nil || free == nil || initializer == nil || finalizer == nil {
-		r.Close(ctx)
-		return nil, fmt.Errorf("one or more required library functions not exported from wasm module")
+		module.Close(ctx)
+		return nil, classify(ErrRuntime, fmt.Errorf("one or more required library functions not exported from wasm module"))
 	}
 
 	result, err := initializer.Call(ctx)
 	if err != nil {
-		r.Close(ctx)
-		return nil, fmt.Errorf("failed to call 'initialize' function: %w", err)
+		module.Close(ctx)
+		return nil, classify(ErrRuntime, fmt.Errorf("failed to call 'initialize' function: %w", err))
 	}
 	if result[0] == 0 {
-		r.Close(ctx)
-		return nil, fmt.Errorf("the ANGLE library's 'initialize' function failed")
+		module.Close(ctx)
+		return nil, classify(ErrRuntime, fmt.Errorf("the ANGLE library's 'initialize' function failed"))
 	}
 
 	return &ShaderTranslator{
@@ -130,118 +278,547 @@ func NewShaderTranslator(ctx context.Context) (*ShaderTranslator, error) {
 		invoker:     invoker,
 		malloc:      malloc,
 		free:        free,
+		config:      config,
 	}, nil
 }
 
-// Close gracefully finalizes the ANGLE library and releases wazero resources.
+// Translate is a one-shot convenience that creates a translator, translates
+// src and closes the translator again. The compiled module is cached across
+// calls, but each call still instantiates a fresh module, so reusing one
+// ShaderTranslator is considerably faster for many translations. The
+// returned Shader cannot be used with RetranslateTo.
+func Translate(ctx context.Context, src, shaderType string, spec ShaderSpec, output OutputFormat) (*Shader, error) {
+	st, err := NewShaderTranslator(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+	return st.TranslateShader(src, shaderType, spec, output)
+}
+
+// WrapLibraryShader returns src, a library of functions without a main,
+// with an empty main appended so it can be validated with TranslateShader.
+// ANGLE has no compile-only mode and rejects sources without an entry
+// point. The wrapper is appended, so reported line numbers are unchanged.
+func WrapLibraryShader(src string) string {
+	if !strings.HasSuffix(src, "\n") {
+		src += "\n"
+	}
+	return src + "void main() {}\n"
+}
+
+// NewShaderTranslatorWithAutoClose is like NewShaderTranslator, but the
+// translator closes itself once ctx is done, which suits translators scoped to
+// one request. Cancelling ctx does not abort a running translation; Close
+// waits for it to finish. The caller may still call Close early, as Close is
+// safe to call more than once, and translations after the context is done
+// fail with ErrClosed.
+func NewShaderTranslatorWithAutoClose(ctx context.Context, opts ...TranslatorOption) (*ShaderTranslator, error) {
+	st, err := NewShaderTranslator(context.WithoutCancel(ctx), opts...)
+	if err != nil {
+		return nil, err
+	}
+	st.stop = make(chan struct{})
+	go func(stop <-chan struct{}) {
+		select {
+		case <-ctx.Done():
+			st.Close()
+		case <-stop:
+		}
+	}(st.stop)
+	return st, nil
+}
+
+// Close gracefully finalizes the ANGLE library and releases wazero resources:
+// the runtime, or only the module for a translator created with
+// NewShaderTranslatorFromCompiled.
+// The runtime is closed even if finalizing fails; the returned error joins
+// the finalizer and runtime errors, so a dirty shutdown is never silent.
 func (st *ShaderTranslator) Close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
 	if st.closed {
 		return nil
 	}
+	if st.stop != nil {
+		close(st.stop)
+		st.stop = nil
+	}
+	var finalizeErr error
 	if _, err := st.finalizer.Call(st.ctx); err != nil {
-		log.Printf("warning: call to wasm finalizer failed: %v", err)
+		finalizeErr = classify(ErrRuntime, fmt.Errorf("call to wasm finalizer failed: %w", err))
 	}
-	if err := st.runtime.Close(st.ctx); err != nil {
-		return fmt.Errorf("failed to close wazero runtime: %w", err)
+	if st.borrowed {
+		if err := st.module.Close(st.ctx); err != nil {
+			return errors.Join(finalizeErr, classify(ErrRuntime, fmt.Errorf("failed to close wasm module: %w", err)))
+		}
+	} else if err := st.runtime.Close(st.ctx); err != nil {
+		return errors.Join(finalizeErr, classify(ErrRuntime, fmt.Errorf("failed to close wazero runtime: %w", err)))
 	}
 	st.closed = true
-	return nil
+	return finalizeErr
 }
 
 // TranslateShader translates shader code by invoking the WASM module.
 func (st *ShaderTranslator) TranslateShader(shaderCode string, shaderType string, spec ShaderSpec, output OutputFormat) (*Shader, error) {
+	return st.TranslateShaderWithOptions(shaderCode, shaderType, spec, output, TranslateOptions{})
+}
+
+// TranslateShaderWithOptions translates shader code like TranslateShader,
+// applying the optional settings in opts.
+func (st *ShaderTranslator) TranslateShaderWithOptions(shaderCode string, shaderType string, spec ShaderSpec, output OutputFormat, opts TranslateOptions) (*Shader, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
 	if st.closed {
-		return nil, fmt.Errorf("translator has been closed")
+		return nil, ErrClosed
+	}
+
+	effectiveSpec, err := cappedSpec(spec, opts.MinGLVersion)
+	if err != nil {
+		return nil, err
+	}
+	if opts.FragOutputName != "" && !isIdentifier(opts.FragOutputName) {
+		return nil, classify(ErrValidation, fmt.Errorf("FragOutputName %q is not a valid identifier", opts.FragOutputName))
+	}
+	if opts.NamePrefix != "" {
+		if opts.DisableNameMapping {
+			return nil, classify(ErrValidation, errors.New("NamePrefix cannot be combined with DisableNameMapping"))
+		}
+		if !isIdentifier(opts.NamePrefix + "x") {
+			return nil, classify(ErrValidation, fmt.Errorf("NamePrefix %q does not start a valid identifier", opts.NamePrefix))
+		}
+	}
+	if opts.ESSLVersion != 0 {
+		if err := checkESSLVersion(opts.ESSLVersion, effectiveSpec, output, opts.ForceVersion); err != nil {
+			return nil, err
+		}
+	}
+	if opts.SkipActiveVariables && len(opts.RemoveUniforms) > 0 {
+		return nil, classify(ErrValidation, errors.New("RemoveUniforms requires the active variables that SkipActiveVariables omits"))
+	}
+	if opts.SkipObjectCode && opts.AssignBlockBindings {
+		return nil, classify(ErrValidation, errors.New("AssignBlockBindings requires the code that SkipObjectCode omits"))
 	}
 
-	shaderCodeB64 := base64.StdEncoding.EncodeToString([]byte(shaderCode))
+	st.lastID++
 	requestPayload := JSONRPCRequest{
 		JsonRPC: "2.0",
-		ID:      1,
+		ID:      st.lastID,
 		Method:  "translate",
 		Params: TranslateRequestParams{
-			ShaderCodeBase64:     shaderCodeB64,
 			ShaderType:           shaderType,
-			Spec:                 spec,
+			Spec:                 effectiveSpec,
 			Output:               output,
-			PrintActiveVariables: true,
-			CompileOptions:       map[string]bool{"objectCode": true},
+			PrintActiveVariables: !opts.SkipActiveVariables,
+			CompileOptions:       opts.compileOptions(),
+			Resources:            opts.Resources,
 		},
 	}
-	requestBytes, err := json.Marshal(requestPayload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request payload: %w", err)
+	input := shaderCode
+	if !opts.RawSource {
+		input = normalizeSource(shaderCode)
 	}
-
-	requestPtr, err := st.writeStringToMemory(requestBytes)
+	source := applyMatrixLayout(input, opts.MatrixLayout)
+	source = applyExtensions(applyDefines(source, opts.Defines), opts.Extensions)
+	start := time.Now()
+	requestPtr, err := st.writeRequestToMemory(requestPayload, []byte(source))
+	st.observe(StageWrite, start)
 	if err != nil {
 		return nil, err
 	}
-	defer st.free.Call(st.ctx, requestPtr)
+	defer func() {
+		start := time.Now()
+		st.free.Call(st.ctx, requestPtr)
+		st.observe(StageFree, start)
+	}()
 
+	start = time.Now()
 	result, err := st.invoker.Call(st.ctx, requestPtr)
+	st.observe(StageInvoke, start)
 	if err != nil {
-		return nil, fmt.Errorf("wasm invoke call failed: %w", err)
+		return nil, classify(ErrRuntime, fmt.Errorf("wasm invoke call failed: %w", err))
 	}
+	st.recordMemoryUsage()
 	responsePtr := result[0]
 	if responsePtr == 0 {
-		return nil, fmt.Errorf("wasm invoke function returned a null pointer")
+		return nil, classify(ErrRuntime, fmt.Errorf("wasm invoke function returned a null pointer"))
 	}
 
+	start = time.Now()
 	responseBytes, err := st.readStringFromMemory(uint32(responsePtr))
+	st.observe(StageRead, start)
 	if err != nil {
 		return nil, err
 	}
 
-	var responseMap map[string]interface{}
-	if err := json.Unmarshal(responseBytes, &responseMap); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal wasm response: %w", err)
+	start = time.Now()
+	shader, err := decodeShader(responseBytes, requestPayload.ID)
+	st.observe(StageDecode, start)
+	if err != nil {
+		return nil, err
+	}
+	shader.source = shaderCode
+	shader.shaderType = shaderType
+	shader.spec = spec
+	shader.options = opts
+	shader.translator = st
+	shader.DefaultPrecisions = parseDefaultPrecisions(input, shaderType)
+	shader.Pragmas = parsePragmas(input)
+	shader.ShaderVersion = versionNumber(source)
+	if effectiveSpec == ShaderSpecWebGLN && shaderType == "fragment" {
+		shader.Diagnostics = append(shader.Diagnostics, highpDowngrades(input)...)
+	}
+	if opts.StrictWarnings {
+		if warnings := filterDiagnostics(shader.Diagnostics, SeverityWarning); len(warnings) > 0 {
+			lines := make([]string, len(warnings))
+			for i, w := range warnings {
+				lines[i] = w.String()
+			}
+			return nil, &TranslateError{
+				Message:     "Shader translation produced warnings.",
+				InfoLog:     strings.Join(lines, "\n"),
+				Diagnostics: warnings,
+			}
+		}
+	}
+	if err := shader.removeUniforms(opts.RemoveUniforms); err != nil {
+		return nil, err
+	}
+	if opts.DisableNameMapping {
+		// names reserved in a desktop GLSL target keep the prefix
+		version := -1
+		if strings.HasPrefix(string(output), "glsl") {
+			version = max(versionNumber(shader.Code), 110, opts.ForceVersion)
+		}
+		shader.renameUserNames(func(name string) string {
+			if glslReserved(name, version) {
+				return userNamePrefix + name
+			}
+			return name
+		})
+	}
+	if opts.NamePrefix != "" {
+		shader.renameUserNames(func(name string) string { return opts.NamePrefix + name })
+	}
+	shader.mapSynthesizedOutputs(opts.FragOutputName)
+	if opts.PreservePrecision {
+		shader.Code = applyPrecision(shader.Code, output, shader.Variables)
+	}
+	shader.Code = applyProfile(shader.Code, output, opts.Profile)
+	if opts.AssignBlockBindings {
+		shader.assignBlockBindings()
 	}
+	if opts.OffsetComments {
+		shader.Code = annotateOffsets(shader.Code, shader.Blocks)
+	}
+	if shader.EarlyFragmentTests && strings.HasPrefix(string(output), "glsl") && output.glslVersion() < 420 {
+		shader.Diagnostics = append(shader.Diagnostics, Diagnostic{
+			Severity: SeverityWarning,
+			Message:  "early_fragment_tests requires GLSL 4.20 or GL_ARB_shader_image_load_store",
+		})
+	}
+	if opts.WarnNonUniformSampling && shaderType == "fragment" {
+		shader.Diagnostics = append(shader.Diagnostics, nonUniformSampling(input, shader.uniformNames())...)
+	}
+	if opts.SkipObjectCode {
+		// the remaining steps only rewrite Code
+		return shader, nil
+	}
+	if opts.ForceVersion != 0 {
+		var warning *Diagnostic
+		shader.Code, warning = applyForceVersion(shader.Code, output, opts.ForceVersion)
+		if warning != nil {
+			shader.Diagnostics = append(shader.Diagnostics, *warning)
+		}
+	}
+	if opts.ESSLVersion != 0 {
+		if shader.Code, err = pinESSLVersion(shader.Code, opts.ESSLVersion); err != nil {
+			return nil, err
+		}
+	}
+	if opts.HeaderComment != "" {
+		shader.Code = addHeaderComment(shader.Code, opts.HeaderComment)
+	}
+	return shader, nil
+}
+
+// ParseShaderResponse builds a Shader from a raw JSON-RPC response of the
+// module's "translate" method, such as one saved from an earlier run, without
+// a translator. A response carrying an error returns a *TranslateError.
+// The Shader only holds what the response contains: it has no source, so
+// RetranslateTo fails and DefaultPrecisions and Pragmas are nil.
+func ParseShaderResponse(resp []byte) (*Shader, error) {
+	response, err := decodeResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	return shaderFromResponse(response)
+}
+
+// decodeShader decodes the module's response to the request with the given
+// id.
+func decodeShader(resp []byte, id int) (*Shader, error) {
+	response, err := decodeResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateResponseID(response, id); err != nil {
+		return nil, err
+	}
+	return shaderFromResponse(response)
+}
 
-	serr, _ := responseMap["error"].(map[string]interface{})
-	if serr != nil {
-		errorMessage, _ := serr["message"].(string)
-		data, _ := serr["data"].(map[string]interface{})
-		log, _ := data["info_log"].(string)
-		return nil, fmt.Errorf("%s\n%s", errorMessage, log)
+// observe reports the time since start for stage to the observer, if any.
+func (st *ShaderTranslator) observe(stage string, start time.Time) {
+	if st.config.Observer != nil {
+		st.config.Observer(stage, time.Since(start))
 	}
-	return newShader(responseMap), nil
 }
 
-func (st *ShaderTranslator) writeStringToMemory(data []byte) (uint64, error) {
-	byteCount := uint64(len(data))
+// decodeResponse unmarshals a module response and checks its JSON-RPC version.
+func decodeResponse(resp []byte) (*jsonRPCResponse, error) {
+	var response jsonRPCResponse
+	if err := json.Unmarshal(resp, &response); err != nil {
+		return nil, classify(ErrProtocol, fmt.Errorf("failed to unmarshal wasm response: %w", err))
+	}
+	if response.JsonRPC != "2.0" {
+		return nil, classify(ErrProtocol, fmt.Errorf("wasm response has unexpected jsonrpc version %q", response.JsonRPC))
+	}
+	return &response, nil
+}
+
+// validateResponseID checks that a module response answers the request with
+// the given id.
+func validateResponseID(response *jsonRPCResponse, id int) error {
+	responseID, ok := response.ID.(float64)
+	if !ok || int(responseID) != id {
+		return classify(ErrProtocol, fmt.Errorf("wasm response id %v does not match request id %d", response.ID, id))
+	}
+	return nil
+}
+
+// shaderFromResponse returns the Shader of a successful response, or the
+// *TranslateError of a failed one.
+func shaderFromResponse(response *jsonRPCResponse) (*Shader, error) {
+	if e := response.Error; e != nil {
+		var log string
+		if e.Data != nil {
+			log = e.Data.InfoLog
+		}
+		return nil, &TranslateError{
+			Code:        e.Code,
+			Message:     e.Message,
+			InfoLog:     log,
+			Diagnostics: parseDiagnostics(log),
+		}
+	}
+	if response.Result == nil {
+		return nil, classify(ErrProtocol, fmt.Errorf("wasm response has neither a result nor an error"))
+	}
+	return newShader(response.Result), nil
+}
+
+// TranslateMulti translates one source to several output formats. The
+// module keeps no parsed state between requests, so each output is a full
+// translation; the method only saves the caller the loop. It stops at the
+// first failure and returns the error annotated with its output format.
+func (st *ShaderTranslator) TranslateMulti(src, shaderType string, spec ShaderSpec, outputs []OutputFormat) (map[OutputFormat]*Shader, error) {
+	shaders := make(map[OutputFormat]*Shader, len(outputs))
+	for _, output := range outputs {
+		if _, ok := shaders[output]; ok {
+			continue
+		}
+		shader, err := st.TranslateShader(src, shaderType, spec, output)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", output, err)
+		}
+		shaders[output] = shader
+	}
+	return shaders, nil
+}
+
+// TranslateProgram translates the stages of one program, keyed by shader
+// type, with the same spec, output and opts, so every stage is validated
+// against the same Resources, Extensions and other settings and the stages
+// cannot disagree in a way that only shows at link time. Stages are
+// translated in pipeline order, vertex first and compute last; it stops at
+// the first failure and returns the error annotated with its shader type.
+// The interfaces between the stages can then be checked with CheckPipeline.
+func (st *ShaderTranslator) TranslateProgram(stages map[ShaderType]string, spec ShaderSpec, output OutputFormat, opts TranslateOptions) (map[ShaderType]*Shader, error) {
+	shaders := make(map[ShaderType]*Shader, len(stages))
+	for _, stage := range append(pipelineOrder, ShaderTypeCompute) {
+		src, ok := stages[stage]
+		if !ok {
+			continue
+		}
+		shader, err := st.TranslateShaderWithOptions(src, string(stage), spec, output, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", stage, err)
+		}
+		shaders[stage] = shader
+	}
+	if len(shaders) != len(stages) {
+		for stage := range stages {
+			if _, ok := shaders[stage]; !ok {
+				return nil, classify(ErrValidation, fmt.Errorf("unknown shader type %q", stage))
+			}
+		}
+	}
+	return shaders, nil
+}
+
+// TranslateWithReflectionJSON translates like TranslateShaderWithOptions
+// and returns the generated code together with the shader's Reflection
+// encoded as indented JSON, ready to cache. Struct fields keep their
+// declaration order and every slice has the order Reflect documents, so
+// translating the same input always yields byte-identical JSON.
+func (st *ShaderTranslator) TranslateWithReflectionJSON(shaderCode string, shaderType string, spec ShaderSpec, output OutputFormat, opts TranslateOptions) (code string, reflectionJSON []byte, err error) {
+	shader, err := st.TranslateShaderWithOptions(shaderCode, shaderType, spec, output, opts)
+	if err != nil {
+		return "", nil, err
+	}
+	reflectionJSON, err = json.MarshalIndent(shader.Reflect(), "", "  ")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal reflection: %w", err)
+	}
+	return shader.Code, reflectionJSON, nil
+}
+
+// probeShader is the smallest shader every spec accepts, used to detect what
+// the module supports.
+const probeShader = "void main() {}\n"
+
+// SupportsOutput reports whether the module can generate output, by
+// translating a trivial vertex shader to it. The embedded module supports
+// the ESSL and GLSL formats; a module built with other ANGLE backends may
+// support more. It returns false on a closed translator.
+func (st *ShaderTranslator) SupportsOutput(output OutputFormat) bool {
+	_, err := st.TranslateShader(probeShader, "vertex", ShaderSpecGLES2, output)
+	return err == nil
+}
+
+// SupportsSpec reports whether the module accepts spec, by translating a
+// trivial vertex shader under it. It returns false on a closed translator.
+func (st *ShaderTranslator) SupportsSpec(spec ShaderSpec) bool {
+	_, err := st.TranslateShader(probeShader, "vertex", spec, OutputFormatESSL)
+	return err == nil
+}
+
+// SpecResult is the outcome of translating a shader under one spec: either
+// Shader is set, or Err holds the failure (a *TranslateError when the module
+// rejected the shader).
+type SpecResult struct {
+	Shader *Shader
+	Err    error
+}
+
+// TranslateAcrossSpecs translates src under each of specs, collecting a
+// result per spec instead of stopping at the first failure, so a tool can
+// report which specs accept the shader and why the others do not.
+func (st *ShaderTranslator) TranslateAcrossSpecs(src, shaderType string, specs []ShaderSpec, output OutputFormat) map[ShaderSpec]SpecResult {
+	results := make(map[ShaderSpec]SpecResult, len(specs))
+	for _, spec := range specs {
+		if _, ok := results[spec]; ok {
+			continue
+		}
+		shader, err := st.TranslateShader(src, shaderType, spec, output)
+		results[spec] = SpecResult{Shader: shader, Err: err}
+	}
+	return results
+}
+
+// MemoryBytes returns the current size of the module's linear memory in bytes.
+// WASM linear memory only grows; it is never returned to the host until the
+// translator is closed.
+func (st *ShaderTranslator) MemoryBytes() uint64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return 0
+	}
+	return uint64(st.module.Memory().Size())
+}
+
+// PeakMemoryBytes returns the largest linear memory size observed after any
+// translation performed by this translator.
+func (st *ShaderTranslator) PeakMemoryBytes() uint64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.peakMemory
+}
+
+// recordMemoryUsage updates peakMemory; the caller holds st.mu.
+func (st *ShaderTranslator) recordMemoryUsage() {
+	if size := uint64(st.module.Memory().Size()); size > st.peakMemory {
+		st.peakMemory = size
+	}
+}
+
+// sourcePlaceholder is the marshaled form of an empty ShaderCodeBase64, which
+// writeRequestToMemory replaces with the encoded source.
+var sourcePlaceholder = []byte(`"shader_code_base64":""`)
+
+// writeRequestToMemory marshals request and copies it into wasm memory as a
+// null-terminated string, base64-encoding source directly into the wasm
+// buffer rather than building the encoded string and marshaled copy on the
+// Go heap first.
+func (st *ShaderTranslator) writeRequestToMemory(request JSONRPCRequest, source []byte) (uint64, error) {
+	request.Params.ShaderCodeBase64 = ""
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return 0, classify(ErrProtocol, fmt.Errorf("failed to marshal request payload: %w", err))
+	}
+	split := bytes.Index(requestBytes, sourcePlaceholder)
+	if split < 0 {
+		return 0, classify(ErrProtocol, fmt.Errorf("marshaled request is missing the shader source field"))
+	}
+	split += len(sourcePlaceholder) - 1 // keep the opening quote in the prefix
+	prefix, suffix := requestBytes[:split], requestBytes[split:]
+
+	encodedLen := uint64(base64.StdEncoding.EncodedLen(len(source)))
+	byteCount := uint64(len(prefix)) + encodedLen + uint64(len(suffix))
 	results, err := st.malloc.Call(st.ctx, byteCount+1)
 	if err != nil {
-		return 0, fmt.Errorf("wasm malloc call failed: %w", err)
+		return 0, classify(ErrRuntime, fmt.Errorf("wasm malloc call failed: %w", err))
 	}
 	ptr := results[0]
 	if ptr == 0 {
-		return 0, fmt.Errorf("wasm malloc failed to allocate memory")
-	}
-	if !st.module.Memory().Write(uint32(ptr), data) {
-		return 0, fmt.Errorf("failed to write to wasm memory")
+		return 0, classify(ErrRuntime, fmt.Errorf("wasm malloc failed to allocate memory"))
 	}
-	if !st.module.Memory().WriteByte(uint32(ptr+byteCount), 0) {
-		return 0, fmt.Errorf("failed to write null terminator to wasm memory")
+	mem := st.module.Memory()
+	buffer, ok := mem.Read(uint32(ptr), uint32(byteCount+1))
+	if !ok {
+		st.free.Call(st.ctx, ptr)
+		return 0, classify(ErrRuntime, fmt.Errorf("failed to write to wasm memory"))
 	}
+	n := copy(buffer, prefix)
+	base64.StdEncoding.Encode(buffer[n:], source)
+	n += int(encodedLen)
+	n += copy(buffer[n:], suffix)
+	buffer[n] = 0
 	return ptr, nil
 }
 
 func (st *ShaderTranslator) readStringFromMemory(ptr uint32) ([]byte, error) {
 	mem := st.module.Memory()
-	memBuffer, ok := mem.Read(ptr, mem.Size()-ptr)
-	if !ok {
-		return nil, fmt.Errorf("failed to read from wasm memory")
+	if ptr > mem.Size() {
+		return nil, classify(ErrRuntime, fmt.Errorf("failed to read from wasm memory"))
 	}
-	var nullTerminatorIndex = -1
-	for i, b := range memBuffer {
-		if b == 0 {
-			nullTerminatorIndex = i
-			break
-		}
+	// scan at most one byte past the limit for the terminator
+	scanLen := mem.Size() - ptr
+	if limit := uint64(st.config.MaxResponseSize) + 1; uint64(scanLen) > limit {
+		scanLen = uint32(limit)
 	}
+	memBuffer, ok := mem.Read(ptr, scanLen)
+	if !ok {
+		return nil, classify(ErrRuntime, fmt.Errorf("failed to read from wasm memory"))
+	}
+	nullTerminatorIndex := bytes.IndexByte(memBuffer, 0)
 	if nullTerminatorIndex == -1 {
-		return nil, fmt.Errorf("string from wasm is not null-terminated")
+		if scanLen > uint32(st.config.MaxResponseSize) {
+			return nil, classify(ErrProtocol, fmt.Errorf("response from wasm exceeds the maximum size of %d bytes", st.config.MaxResponseSize))
+		}
+		return nil, classify(ErrProtocol, fmt.Errorf("string from wasm is not null-terminated"))
 	}
 	return memBuffer[:nullTerminatorIndex], nil
 }
@@ -0,0 +1,2645 @@
+package goshadertranslator
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// newTestTranslator returns a translator that is closed when tb ends.
+func newTestTranslator(tb testing.TB, opts ...TranslatorOption) *ShaderTranslator {
+	tb.Helper()
+	st, err := NewShaderTranslator(context.Background(), opts...)
+	if err != nil {
+		tb.Fatalf("NewShaderTranslator: %v", err)
+	}
+	tb.Cleanup(func() { st.Close() })
+	return st
+}
+
+// mustTranslate translates src with st and fails tb if that fails.
+func mustTranslate(tb testing.TB, st *ShaderTranslator, src, shaderType string, spec ShaderSpec, output OutputFormat, opts TranslateOptions) *Shader {
+	tb.Helper()
+	shader, err := st.TranslateShaderWithOptions(src, shaderType, spec, output, opts)
+	if err != nil {
+		tb.Fatalf("TranslateShaderWithOptions: %v", err)
+	}
+	return shader
+}
+
+// benchmarkSource returns an ESSL 3.00 fragment shader of about 8 KiB.
+func benchmarkSource() string {
+	var b strings.Builder
+	b.WriteString("#version 300 es\nprecision mediump float;\nuniform vec4 tint;\nout vec4 color;\n")
+	for i := 0; i < 64; i++ {
+		fmt.Fprintf(&b, "vec4 shade%d(vec4 c) {\n    return c * float(%d) + tint * 0.5;\n}\n", i, i)
+	}
+	b.WriteString("void main() {\n    vec4 c = tint;\n")
+	for i := 0; i < 64; i++ {
+		fmt.Fprintf(&b, "    c = shade%d(c);\n", i)
+	}
+	b.WriteString("    color = c;\n}\n")
+	return b.String()
+}
+
+// benchmarkRequest returns the request TranslateShader sends for source.
+func benchmarkRequest() JSONRPCRequest {
+	return JSONRPCRequest{
+		JsonRPC: "2.0",
+		ID:      1,
+		Method:  "translate",
+		Params: TranslateRequestParams{
+			ShaderType:           "fragment",
+			Spec:                 ShaderSpecGLES3,
+			Output:               OutputFormatGLSL330,
+			PrintActiveVariables: true,
+			CompileOptions:       TranslateOptions{}.compileOptions(),
+		},
+	}
+}
+
+// BenchmarkWriteRequest measures writeRequestToMemory, which encodes the
+// source straight into the wasm buffer.
+func BenchmarkWriteRequest(b *testing.B) {
+	st := newTestTranslator(b)
+	request, source := benchmarkRequest(), []byte(benchmarkSource())
+	b.SetBytes(int64(len(source)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ptr, err := st.writeRequestToMemory(request, source)
+		if err != nil {
+			b.Fatal(err)
+		}
+		st.free.Call(st.ctx, ptr)
+	}
+}
+
+// BenchmarkWriteRequestMarshaled measures the approach writeRequestToMemory
+// replaced, for comparison: the source is encoded to a string, marshaled
+// into the request on the Go heap and the result copied into wasm memory.
+func BenchmarkWriteRequestMarshaled(b *testing.B) {
+	st := newTestTranslator(b)
+	request, source := benchmarkRequest(), []byte(benchmarkSource())
+	b.SetBytes(int64(len(source)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		request.Params.ShaderCodeBase64 = base64.StdEncoding.EncodeToString(source)
+		requestBytes, err := json.Marshal(request)
+		if err != nil {
+			b.Fatal(err)
+		}
+		results, err := st.malloc.Call(st.ctx, uint64(len(requestBytes))+1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ptr := results[0]
+		mem := st.module.Memory()
+		if !mem.Write(uint32(ptr), requestBytes) || !mem.WriteByte(uint32(ptr)+uint32(len(requestBytes)), 0) {
+			b.Fatal("failed to write to wasm memory")
+		}
+		st.free.Call(st.ctx, ptr)
+	}
+}
+
+func TestDecodeShaderValidatesEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    string
+		wantErr bool
+	}{
+		{"valid", `{"jsonrpc":"2.0","id":7,"result":{"object_code":"void main(){}"}}`, false},
+		{"wrong version", `{"jsonrpc":"1.0","id":7,"result":{}}`, true},
+		{"missing version", `{"id":7,"result":{}}`, true},
+		{"wrong id", `{"jsonrpc":"2.0","id":8,"result":{}}`, true},
+		{"string id", `{"jsonrpc":"2.0","id":"7","result":{}}`, true},
+		{"missing id", `{"jsonrpc":"2.0","result":{}}`, true},
+		{"no result or error", `{"jsonrpc":"2.0","id":7}`, true},
+		{"malformed", `{"jsonrpc":"2.0","id":7`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader, err := decodeShader([]byte(tt.resp), 7)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("decodeShader: %v", err)
+				}
+				if shader.Code != "void main(){}" {
+					t.Errorf("Code = %q", shader.Code)
+				}
+				return
+			}
+			if !errors.Is(err, ErrProtocol) {
+				t.Errorf("decodeShader error = %v, want ErrProtocol", err)
+			}
+		})
+	}
+}
+
+// multiOutputs are the formats the TranslateMulti benchmarks translate to.
+var multiOutputs = []OutputFormat{OutputFormatESSL, OutputFormatGLSL330, OutputFormatGLSL450}
+
+// BenchmarkTranslateMulti and BenchmarkTranslateSeparately show that
+// TranslateMulti costs the same as one TranslateShader call per output,
+// since the module keeps no parsed state between requests.
+func BenchmarkTranslateMulti(b *testing.B) {
+	st := newTestTranslator(b)
+	source := benchmarkSource()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := st.TranslateMulti(source, "fragment", ShaderSpecGLES3, multiOutputs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTranslateSeparately(b *testing.B) {
+	st := newTestTranslator(b)
+	source := benchmarkSource()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, output := range multiOutputs {
+			if _, err := st.TranslateShader(source, "fragment", ShaderSpecGLES3, output); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestCloseReportsFinalizerFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		// sabotage runs before Close
+		sabotage func(st *ShaderTranslator)
+		wantErr  bool
+	}{
+		{"clean", func(*ShaderTranslator) {}, false},
+		{
+			// the finalizer cannot run in a module that is already closed
+			"finalizer fails",
+			func(st *ShaderTranslator) { st.module.Close(st.ctx) },
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := NewShaderTranslator(context.Background())
+			if err != nil {
+				t.Fatalf("NewShaderTranslator: %v", err)
+			}
+			tt.sabotage(st)
+			err = st.Close()
+			if tt.wantErr {
+				if !errors.Is(err, ErrRuntime) || !strings.Contains(err.Error(), "finalizer") {
+					t.Errorf("Close error = %v, want a finalizer ErrRuntime", err)
+				}
+			} else if err != nil {
+				t.Errorf("Close: %v", err)
+			}
+			// the runtime is closed regardless, so closing again is a no-op
+			if err := st.Close(); err != nil {
+				t.Errorf("second Close: %v", err)
+			}
+			if _, err := st.TranslateShader("void main() {}", "vertex", ShaderSpecGLES2, OutputFormatESSL); !errors.Is(err, ErrClosed) {
+				t.Errorf("TranslateShader after Close error = %v, want ErrClosed", err)
+			}
+		})
+	}
+}
+
+func TestGetCompiledModuleCompilesOnce(t *testing.T) {
+	tests := []struct {
+		name   string
+		engine Engine
+		opts   []TranslatorOption
+	}{
+		{"auto", EngineAuto, nil},
+		{"interpreter", EngineInterpreter, []TranslatorOption{WithInterpreter()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// earlier tests may have compiled the module already
+			firstCompile[tt.engine] = sync.Once{}
+			// a cold compile starts before any other has finished, so it
+			// cannot find the machine code in compilationCache
+			var compiles, cold, finished atomic.Int32
+			compile := compileModule
+			compileModule = func(ctx context.Context, r wazero.Runtime) (wazero.CompiledModule, error) {
+				if finished.Load() == 0 {
+					cold.Add(1)
+				}
+				compiles.Add(1)
+				defer finished.Add(1)
+				return compile(ctx, r)
+			}
+			t.Cleanup(func() { compileModule = compile })
+
+			const translators = 8
+			errs := make(chan error, translators)
+			var wg sync.WaitGroup
+			for i := 0; i < translators; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					st, err := NewShaderTranslator(context.Background(), tt.opts...)
+					if err == nil {
+						err = st.Close()
+					}
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+			if n := compiles.Load(); n != translators {
+				t.Errorf("module compiled %d times, want once per translator (%d)", n, translators)
+			}
+			if n := cold.Load(); n != 1 {
+				t.Errorf("%d compilations ran before the first finished, want 1", n)
+			}
+		})
+	}
+}
+
+func TestFitsResourcesComputeWorkGroup(t *testing.T) {
+	st := newTestTranslator(t)
+	shader := mustTranslate(t, st, "#version 310 es\nlayout(local_size_x = 64, local_size_y = 4) in;\nvoid main() {}\n",
+		"compute", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+	tests := []struct {
+		name string
+		r    Resources
+		want []string
+	}{
+		{"fits", Resources{MaxComputeWorkGroupSize: [3]int{128, 128, 64}, MaxComputeWorkGroupInvocations: 256}, nil},
+		{"no limits", Resources{}, nil},
+		{"size", Resources{MaxComputeWorkGroupSize: [3]int{32, 0, 0}}, []string{"work group size x: 64 exceeds MaxComputeWorkGroupSize[0] 32"}},
+		{"invocations", Resources{MaxComputeWorkGroupInvocations: 128}, []string{"work group invocations: 256 exceeds MaxComputeWorkGroupInvocations 128"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shader.FitsResources(tt.r); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FitsResources = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReflectMultisampleSamplers(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 310 es
+precision mediump float;
+uniform mediump sampler2DMS ms;
+uniform mediump isampler2DMS ims;
+uniform sampler2D plain;
+out vec4 color;
+void main() {
+    color = texelFetch(ms, ivec2(0), 1) + vec4(texelFetch(ims, ivec2(0), 0)) + texture(plain, vec2(0.5));
+}
+`
+	shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+	want := map[string]bool{"ms": true, "ims": true, "plain": false}
+	samplers := shader.Reflect().Samplers
+	if len(samplers) != len(want) {
+		t.Fatalf("Samplers = %+v, want %d of them", samplers, len(want))
+	}
+	for _, s := range samplers {
+		if s.Multisample != want[s.Name] {
+			t.Errorf("sampler %q: Multisample = %v, want %v", s.Name, s.Multisample, want[s.Name])
+		}
+	}
+
+	// ESSL 3.00 has no built-in sampler2DMS
+	essl300 := strings.Replace(src, "#version 310 es", "#version 300 es", 1)
+	_, err := st.TranslateShader(essl300, "fragment", ShaderSpecGLES3, OutputFormatESSL)
+	var terr *TranslateError
+	if !errors.As(err, &terr) || !strings.Contains(terr.InfoLog, "sampler2DMS") {
+		t.Errorf("ESSL 3.00 translation error = %v, want one about sampler2DMS", err)
+	}
+}
+
+func TestShaderVersion(t *testing.T) {
+	st := newTestTranslator(t)
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"no directive", "", 100},
+		{"100", "#version 100\n", 100},
+		{"300 es", "#version 300 es\n", 300},
+		{"310 es", "#version 310 es\n", 310},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := tt.header + "void main() {\n    gl_Position = vec4(0.0);\n}\n"
+			// the output's own #version must not leak into ShaderVersion
+			shader := mustTranslate(t, st, src, "vertex", ShaderSpecGLES31, OutputFormatGLSL450, TranslateOptions{})
+			if shader.ShaderVersion != tt.want {
+				t.Errorf("ShaderVersion = %d, want %d", shader.ShaderVersion, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewShaderTranslatorEngines(t *testing.T) {
+	tests := []struct {
+		name    string
+		engine  Engine
+		wantErr bool
+	}{
+		{"auto", EngineAuto, false},
+		{"compiler", EngineCompiler, false},
+		{"interpreter", EngineInterpreter, false},
+		{"negative", -1, true},
+		{"past the last", EngineInterpreter + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := NewShaderTranslator(context.Background(), func(c *TranslatorConfig) { c.Engine = tt.engine })
+			if tt.wantErr {
+				if !errors.Is(err, ErrRuntime) {
+					t.Errorf("NewShaderTranslator error = %v, want ErrRuntime", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewShaderTranslator: %v", err)
+			}
+			defer st.Close()
+			if _, err := st.TranslateShader("void main() {}", "fragment", ShaderSpecGLES2, OutputFormatESSL); err != nil {
+				t.Errorf("TranslateShader: %v", err)
+			}
+		})
+	}
+}
+
+func TestHighpDowngradeWarnings(t *testing.T) {
+	st := newTestTranslator(t)
+	tests := []struct {
+		name      string
+		src       string
+		wantLines []int
+		wantCode  string // a substring of Code, if any
+	}{
+		{
+			"variable qualifier",
+			"precision mediump float;\nuniform highp vec4 tint;\nvoid main() {\n    gl_FragColor = tint;\n}\n",
+			[]int{2},
+			"uniform mediump vec4",
+		},
+		{
+			"guarded by GL_FRAGMENT_PRECISION_HIGH",
+			"#ifdef GL_FRAGMENT_PRECISION_HIGH\nprecision highp float;\n#else\nprecision mediump float;\n#endif\nuniform vec4 tint;\nvoid main() {\n    gl_FragColor = tint;\n}\n",
+			nil,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader := mustTranslate(t, st, tt.src, "fragment", ShaderSpecWebGLN, OutputFormatESSL, TranslateOptions{})
+			var lines []int
+			for _, d := range shader.Diagnostics {
+				if d.Token == "highp" {
+					lines = append(lines, d.Line)
+				}
+			}
+			if !reflect.DeepEqual(lines, tt.wantLines) {
+				t.Errorf("highp warnings on lines %v, want %v", lines, tt.wantLines)
+			}
+			if !strings.Contains(shader.Code, tt.wantCode) || strings.Contains(shader.Code, "highp") {
+				t.Errorf("Code keeps highp or lacks %q:\n%s", tt.wantCode, shader.Code)
+			}
+		})
+	}
+
+	// a highp default precision is an error, not a downgrade
+	_, err := st.TranslateShader("precision highp float;\nvoid main() {\n    gl_FragColor = vec4(1.0);\n}\n", "fragment", ShaderSpecWebGLN, OutputFormatESSL)
+	if !errors.Is(err, ErrCompile) {
+		t.Errorf("precision highp error = %v, want ErrCompile", err)
+	}
+}
+
+func TestVertexAttributeDescriptors(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 300 es
+layout(location = 2) in vec3 pos;
+in mat4 inst;
+in int id;
+in vec4 color;
+void main() {
+    gl_Position = inst * vec4(pos, 1.0) + color * float(id);
+}
+`
+	shader := mustTranslate(t, st, src, "vertex", ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{})
+	want := []AttribDescriptor{
+		{Name: "pos", Location: 2, ComponentType: glFloat, ComponentCount: 3, SlotCount: 1},
+		// the mat4 does not fit below pos, so it goes after it
+		{Name: "inst", Location: 3, ComponentType: glFloat, ComponentCount: 4, SlotCount: 4},
+		{Name: "id", Location: 0, ComponentType: glInt, ComponentCount: 1, Integer: true, SlotCount: 1},
+		{Name: "color", Location: 1, ComponentType: glFloat, ComponentCount: 4, Normalized: true, SlotCount: 1},
+	}
+	got := shader.VertexAttributeDescriptors()
+	for i := range got {
+		got[i].MappedName = ""
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("VertexAttributeDescriptors =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+// layoutSource declares std140, std430 and shared blocks with struct
+// arrays and row- and column-major matrices, for the layout tests.
+const layoutSource = `#version 310 es
+precision mediump float;
+struct Light { vec3 dir; float power; };
+struct T { mat2x3 n; float x; };
+layout(std140, row_major) uniform A { mat3 m; float f; Light lights[2]; T t; } a;
+layout(std140) uniform C { layout(column_major) mat3 c; float g; Light ls[2]; } c;
+layout(std430, binding = 1) buffer S { vec3 v; float h; Light ls[2]; layout(row_major) mat3 r; float after; } s;
+layout(shared) uniform Sh { vec4 x; } sh;
+out vec4 color;
+void main() {
+    color = vec4(a.m[0], a.f) + vec4(a.lights[1].dir, a.t.x) + vec4(a.t.n[0], 1.0)
+        + vec4(c.c[0], c.g) + vec4(c.ls[1].dir, c.ls[0].power)
+        + vec4(s.v, s.h) + vec4(s.r[0], s.ls[1].power + s.after) + sh.x;
+}
+`
+
+// blockByName returns the block of shader named name, failing tb if there
+// is none.
+func blockByName(tb testing.TB, shader *Shader, name string) InterfaceBlock {
+	tb.Helper()
+	for _, b := range shader.Blocks {
+		if b.Name == name {
+			return b
+		}
+	}
+	tb.Fatalf("no block %q", name)
+	return InterfaceBlock{}
+}
+
+func TestBlockMemberLayout(t *testing.T) {
+	st := newTestTranslator(t)
+	shader := mustTranslate(t, st, layoutSource, "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+	type layout struct {
+		offset, arrayStride, matrixStride int
+		rowMajor                          bool
+	}
+	tests := []struct {
+		block string
+		path  []string // field names from the block down
+		want  layout
+	}{
+		// std140, row_major block
+		{"A", []string{"m"}, layout{0, 0, 16, true}},
+		{"A", []string{"f"}, layout{48, 0, 0, false}},
+		{"A", []string{"lights"}, layout{64, 16, 0, false}},
+		{"A", []string{"lights", "dir"}, layout{0, 0, 0, false}},
+		{"A", []string{"lights", "power"}, layout{12, 0, 0, false}},
+		{"A", []string{"t"}, layout{96, 0, 0, false}},
+		// inherits row_major from t: three rows of two components
+		{"A", []string{"t", "n"}, layout{0, 0, 16, true}},
+		{"A", []string{"t", "x"}, layout{48, 0, 0, false}},
+		// std140, column_major member
+		{"C", []string{"c"}, layout{0, 0, 16, false}},
+		{"C", []string{"g"}, layout{48, 0, 0, false}},
+		{"C", []string{"ls"}, layout{64, 16, 0, false}},
+		// std430
+		{"S", []string{"v"}, layout{0, 0, 0, false}},
+		{"S", []string{"h"}, layout{12, 0, 0, false}},
+		{"S", []string{"ls"}, layout{16, 16, 0, false}},
+		{"S", []string{"ls", "power"}, layout{12, 0, 0, false}},
+		{"S", []string{"r"}, layout{48, 0, 16, true}},
+		{"S", []string{"after"}, layout{96, 0, 0, false}},
+		// shared offsets are implementation defined
+		{"Sh", []string{"x"}, layout{-1, 0, 0, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.block+"."+strings.Join(tt.path, "."), func(t *testing.T) {
+			fields := blockByName(t, shader, tt.block).Fields
+			var v ShaderVariable
+			for _, name := range tt.path {
+				i := slices.IndexFunc(fields, func(f ShaderVariable) bool { return f.Name == name })
+				if i < 0 {
+					t.Fatalf("no field %q", name)
+				}
+				v, fields = fields[i], fields[i].Fields
+			}
+			got := layout{v.Offset, v.ArrayStride, v.MatrixStride, v.IsRowMajor}
+			if got != tt.want {
+				t.Errorf("layout = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOffsetComments(t *testing.T) {
+	st := newTestTranslator(t)
+	shader := mustTranslate(t, st, layoutSource, "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{OffsetComments: true})
+	for _, b := range shader.Blocks {
+		start, end, ok := findBlockBody(shader.Code, b.MappedName)
+		if !ok {
+			t.Fatalf("no declaration of block %q in Code", b.Name)
+		}
+		for _, f := range b.Fields {
+			m := regexp.MustCompile(`\b` + f.MappedName + `(?:\[\d+\])?; // offset (\d+)`).FindStringSubmatch(shader.Code[start:end])
+			switch {
+			case f.Offset < 0 && m != nil:
+				t.Errorf("%s.%s: comment %q for a member without an offset", b.Name, f.Name, m[0])
+			case f.Offset >= 0 && (m == nil || m[1] != strconv.Itoa(f.Offset)):
+				t.Errorf("%s.%s: comment %q, want offset %d", b.Name, f.Name, m, f.Offset)
+			}
+		}
+	}
+
+	plain := mustTranslate(t, st, layoutSource, "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+	if strings.Contains(plain.Code, "// offset") {
+		t.Errorf("offset comments without OffsetComments:\n%s", plain.Code)
+	}
+}
+
+func TestAssignBlockBindings(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 310 es
+precision mediump float;
+layout(std140) uniform A { vec4 a; };
+layout(std140, binding = 0) uniform B { vec4 b; };
+uniform C { vec4 c; };
+layout(std430) buffer S { vec4 s; };
+out vec4 color;
+void main() {
+    color = a + b + c + s;
+}
+`
+	tests := []struct {
+		name        string
+		assign      bool
+		wantBinding map[string]int
+	}{
+		// B keeps its source binding; the others fill the gaps of their
+		// binding space in declaration order
+		{"assigned", true, map[string]int{"A": 1, "B": 0, "C": 2, "S": 0}},
+		{"off", false, map[string]int{"A": -1, "B": 0, "C": -1, "S": -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{AssignBlockBindings: tt.assign})
+			for name, want := range tt.wantBinding {
+				b := blockByName(t, shader, name)
+				if b.Binding != want {
+					t.Errorf("block %s: Binding = %d, want %d", name, b.Binding, want)
+				}
+				declared := regexp.MustCompile(`binding = (\d+)\) (?:uniform|buffer) ` + b.MappedName + `\{`).FindStringSubmatch(shader.Code)
+				if want < 0 && declared != nil || want >= 0 && (declared == nil || declared[1] != strconv.Itoa(want)) {
+					t.Errorf("block %s: declaration binding %q, want %d in\n%s", name, declared, want, shader.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestDefines(t *testing.T) {
+	st := newTestTranslator(t)
+	defines := map[string]string{"RED": "", "SCALE": "0.25"}
+	body := "void main() {\n#ifdef RED\n    COLOR = vec4(SCALE);\n#else\n    COLOR = vec4(0.75);\n#endif\n}\n"
+	tests := []struct {
+		name, src string
+		spec      ShaderSpec
+	}{
+		{"after version", "#version 300 es\nprecision mediump float;\nout vec4 color;\n#define COLOR color\n" + body, ShaderSpecGLES3},
+		{"no version", "precision mediump float;\n#define COLOR gl_FragColor\n" + body, ShaderSpecGLES2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the defines must follow #version, which has to stay first
+			source := applyDefines(tt.src, defines)
+			if i, j := strings.Index(source, "#define RED"), strings.Index(source, "#version"); i < j {
+				t.Errorf("defines precede #version:\n%s", source)
+			}
+
+			shader := mustTranslate(t, st, tt.src, "fragment", tt.spec, OutputFormatESSL, TranslateOptions{Defines: defines})
+			if !strings.Contains(shader.Code, "0.25") || strings.Contains(shader.Code, "0.75") {
+				t.Errorf("defines not visible to the shader:\n%s", shader.Code)
+			}
+			plain := mustTranslate(t, st, tt.src, "fragment", tt.spec, OutputFormatESSL, TranslateOptions{})
+			if !strings.Contains(plain.Code, "0.75") {
+				t.Errorf("RED defined without Defines:\n%s", plain.Code)
+			}
+
+			// errors still report the line of the original source
+			broken := strings.Replace(tt.src, "vec4(SCALE)", "vec4(undeclared)", 1)
+			line := 1 + strings.Count(broken[:strings.Index(broken, "undeclared")], "\n")
+			_, err := st.TranslateShaderWithOptions(broken, "fragment", tt.spec, OutputFormatESSL, TranslateOptions{Defines: defines})
+			if want := fmt.Sprintf("0:%d: 'undeclared'", line); err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("error = %v, want one containing %q", err, want)
+			}
+		})
+	}
+}
+
+func TestDisableNameMappingReservedWords(t *testing.T) {
+	st := newTestTranslator(t)
+	// ESSL 1.00 reserves neither word
+	src := `uniform vec4 sample;
+uniform vec4 buffer;
+uniform vec4 plain;
+void main() {
+    gl_Position = sample + buffer + plain;
+}
+`
+	tests := []struct {
+		output OutputFormat
+		want   map[string]string
+	}{
+		{OutputFormatGLSL330, map[string]string{"sample": "sample", "buffer": "buffer", "plain": "plain"}},
+		// buffer is only reserved from GLSL 4.30 on
+		{OutputFormatGLSL420, map[string]string{"sample": "_usample", "buffer": "buffer", "plain": "plain"}},
+		{OutputFormatGLSL430, map[string]string{"sample": "_usample", "buffer": "_ubuffer", "plain": "plain"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.output), func(t *testing.T) {
+			shader := mustTranslate(t, st, src, "vertex", ShaderSpecGLES2, tt.output, TranslateOptions{DisableNameMapping: true})
+			names := shader.MappedNames()
+			for name, want := range tt.want {
+				if names[name] != want {
+					t.Errorf("MappedNames()[%q] = %q, want %q", name, names[name], want)
+				}
+				if !regexp.MustCompile(`uniform \w+ ` + want + `;`).MatchString(shader.Code) {
+					t.Errorf("Code does not declare %q:\n%s", want, shader.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveUniforms(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 300 es
+precision mediump float;
+uniform vec4 unused;
+uniform vec4 tint;
+out vec4 color;
+void main() {
+    color = tint;
+}
+`
+	tests := []struct {
+		name    string
+		remove  []string
+		wantErr bool
+	}{
+		{"unused", []string{"unused"}, false},
+		{"undeclared", []string{"missing"}, false},
+		{"used", []string{"unused", "tint"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader, err := st.TranslateShaderWithOptions(src, "fragment", ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{RemoveUniforms: tt.remove})
+			if tt.wantErr {
+				if !errors.Is(err, ErrValidation) {
+					t.Fatalf("err = %v, want ErrValidation", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			removed := slices.Contains(tt.remove, "unused")
+			if _, ok := shader.Variables["unused"]; ok == removed {
+				t.Errorf("Variables has unused = %v, want %v", ok, !removed)
+			}
+			if slices.Contains(shader.order, "unused") == removed {
+				t.Errorf("order = %q", shader.order)
+			}
+			if strings.Contains(shader.Code, "_uunused") == removed {
+				t.Errorf("Code:\n%s", shader.Code)
+			}
+			if _, ok := shader.Variables["tint"]; !ok || !strings.Contains(shader.Code, "uniform vec4 _utint;") {
+				t.Errorf("tint removed:\n%s", shader.Code)
+			}
+		})
+	}
+}
+
+func TestDeclarationOrderIsStable(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 300 es
+in vec4 b;
+in vec4 a;
+uniform vec4 z;
+uniform vec4 y;
+out vec4 v;
+void main() {
+    v = a + y;
+    gl_Position = b + z;
+}
+`
+	// categories in name order, variables in declaration order within each
+	want := []string{"b", "a", "v", "z", "y"}
+	for i := 0; i < 20; i++ {
+		shader := mustTranslate(t, st, src, "vertex", ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{})
+		var got []string
+		for _, name := range shader.order {
+			if !strings.HasPrefix(name, "gl_") {
+				got = append(got, name)
+			}
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("run %d: order = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestUsesDerivatives(t *testing.T) {
+	st := newTestTranslator(t)
+	tests := []struct {
+		name, expr string
+		want       bool
+	}{
+		{"none", "v", false},
+		{"dFdx", "dFdx(v)", true},
+		{"dFdy", "dFdy(v)", true},
+		{"fwidth", "fwidth(v)", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := "#version 300 es\nprecision mediump float;\nin vec4 v;\nout vec4 color;\nvoid main() {\n    color = " + tt.expr + ";\n}\n"
+			for _, output := range []OutputFormat{OutputFormatESSL, OutputFormatGLSL330} {
+				shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES3, output, TranslateOptions{})
+				if shader.UsesDerivatives != tt.want {
+					t.Errorf("%s: UsesDerivatives = %v, want %v", output, shader.UsesDerivatives, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestProfile(t *testing.T) {
+	st := newTestTranslator(t)
+	src := "#version 300 es\nin vec4 pos;\nvoid main() {\n    gl_Position = pos;\n}\n"
+	tests := []struct {
+		output  OutputFormat
+		profile GLSLProfile
+		want    string
+	}{
+		{OutputFormatGLSL150, GLSLProfileDefault, "#version 150\n"},
+		{OutputFormatGLSL150, GLSLProfileCore, "#version 150 core\n"},
+		{OutputFormatGLSL150, GLSLProfileCompatibility, "#version 150 compatibility\n"},
+		{OutputFormatGLSL330, GLSLProfileCore, "#version 330 core\n"},
+		{OutputFormatGLSL450, GLSLProfileCompatibility, "#version 450 compatibility\n"},
+		// versions without profiles ignore it
+		{OutputFormatGLSL140, GLSLProfileCore, "#version 140\n"},
+		{OutputFormatESSL, GLSLProfileCore, "#version 300 es\n"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s", tt.output, tt.profile), func(t *testing.T) {
+			shader := mustTranslate(t, st, src, "vertex", ShaderSpecGLES3, tt.output, TranslateOptions{Profile: tt.profile})
+			if !strings.HasPrefix(shader.Code, tt.want) {
+				t.Errorf("Code starts with %q, want %q", strings.SplitAfter(shader.Code, "\n")[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestSamplerBindings(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 310 es
+precision mediump float;
+layout(binding = 2) uniform sampler2D bound;
+uniform sampler2D unbound;
+layout(binding = 3, rgba8) uniform readonly highp image2D img;
+out vec4 color;
+void main() {
+    color = texture(bound, vec2(0.0)) + texture(unbound, vec2(0.0)) + imageLoad(img, ivec2(0));
+}
+`
+	shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+	r := shader.Reflect()
+	want := map[string]int{"bound": 2, "unbound": -1}
+	if len(r.Samplers) != len(want) {
+		t.Fatalf("Samplers = %+v", r.Samplers)
+	}
+	for _, s := range r.Samplers {
+		if s.Binding != want[s.Name] {
+			t.Errorf("sampler %q Binding = %d, want %d", s.Name, s.Binding, want[s.Name])
+		}
+	}
+	if len(r.Images) != 1 || r.Images[0].Binding != 3 {
+		t.Errorf("Images = %+v, want img at binding 3", r.Images)
+	}
+}
+
+func TestMemoryBytes(t *testing.T) {
+	st, err := NewShaderTranslator(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial := st.MemoryBytes()
+	if initial == 0 || initial%65536 != 0 {
+		t.Fatalf("MemoryBytes() = %d, want a non-zero multiple of the 64 KiB page size", initial)
+	}
+	if peak := st.PeakMemoryBytes(); peak != 0 {
+		t.Errorf("PeakMemoryBytes() = %d before any translation, want 0", peak)
+	}
+	last := initial
+	for i := 0; i < 2; i++ {
+		if _, err := st.TranslateShader(benchmarkSource(), "fragment", ShaderSpecGLES3, OutputFormatGLSL330); err != nil {
+			t.Fatal(err)
+		}
+		got := st.MemoryBytes()
+		if got < last {
+			t.Errorf("MemoryBytes() shrank from %d to %d", last, got)
+		}
+		if peak := st.PeakMemoryBytes(); peak != got {
+			t.Errorf("PeakMemoryBytes() = %d, want the current size %d", peak, got)
+		}
+		last = got
+	}
+	st.Close()
+	if got := st.MemoryBytes(); got != 0 {
+		t.Errorf("MemoryBytes() = %d after Close, want 0", got)
+	}
+}
+
+func TestPreservePrecision(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 300 es
+precision mediump float;
+uniform highp vec4 tint;
+in mediump vec2 uv;
+out lowp vec4 color;
+void main() {
+    color = tint * uv.x;
+}
+`
+	tests := []struct {
+		output   OutputFormat
+		preserve bool
+		want     []string
+	}{
+		{OutputFormatGLSL330, false, []string{"uniform vec4 _utint;", "in vec2 _uuv;", "out vec4 _ucolor;"}},
+		{OutputFormatGLSL330, true, []string{"uniform highp vec4 _utint;", "in mediump vec2 _uuv;", "out lowp vec4 _ucolor;"}},
+		{OutputFormatGLSL130, true, []string{"uniform highp vec4 _utint;", "in mediump vec2 _uuv;", "out lowp vec4 _ucolor;"}},
+		// GLSL 1.10 has no precision qualifiers, so they become comments
+		{OutputFormatGLSL, true, []string{"uniform vec4 _utint; // highp", "in vec2 _uuv; // mediump", "out vec4 _ucolor; // lowp"}},
+		{OutputFormatESSL, false, []string{"uniform highp vec4 _utint;", "in mediump vec2 _uuv;", "out lowp vec4 _ucolor;"}},
+		{OutputFormatESSL, true, []string{"uniform highp vec4 _utint;", "in mediump vec2 _uuv;", "out lowp vec4 _ucolor;"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%v", tt.output, tt.preserve), func(t *testing.T) {
+			shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES3, tt.output, TranslateOptions{PreservePrecision: tt.preserve})
+			for _, want := range tt.want {
+				if !strings.Contains(shader.Code, want+"\n") {
+					t.Errorf("Code lacks %q:\n%s", want, shader.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestAttributeSlotCount(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 300 es
+in float f;
+in mat2 m2;
+in mat3 m3;
+layout(location = 2) in mat4 m4;
+void main() {
+    gl_Position = vec4(f) + vec4(m2[0], m3[0].xy) + m4[0];
+}
+`
+	translated := mustTranslate(t, st, src, "vertex", ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{})
+	// GLSL ES has no attribute arrays, so they come from a saved response
+	saved, err := ParseShaderResponse([]byte(`{"jsonrpc":"2.0","id":1,"result":{"active_variables":{"attributes":[
+		{"name":"arr","mapped_name":"_uarr","type_enum":35666,"array_sizes":[3]},
+		{"name":"marr","mapped_name":"_umarr","type_enum":35674,"array_sizes":[2]}]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		shader   *Shader
+		name     string
+		slots    int
+		location int
+	}{
+		{translated, "f", 1, -1},
+		{translated, "m2", 2, -1},
+		{translated, "m3", 3, -1},
+		{translated, "m4", 4, 2},
+		{saved, "arr", 3, -1},
+		{saved, "marr", 4, -1},
+	}
+	for _, tt := range tests {
+		v, ok := tt.shader.Variables[tt.name]
+		if !ok {
+			t.Errorf("no attribute %q", tt.name)
+			continue
+		}
+		if v.SlotCount != tt.slots || v.Location != tt.location {
+			t.Errorf("%s: SlotCount %d, Location %d, want %d, %d", tt.name, v.SlotCount, v.Location, tt.slots, tt.location)
+		}
+	}
+}
+
+func TestStrictWarnings(t *testing.T) {
+	st := newTestTranslator(t)
+	clean := "#version 300 es\nprecision mediump float;\nout vec4 color;\nvoid main() {\n    color = vec4(1.0);\n}\n"
+	warns := "#version 300 es\n#pragma mytool\n#pragma othertool\nprecision mediump float;\nout vec4 color;\nvoid main() {\n    color = vec4(1.0);\n}\n"
+	tests := []struct {
+		name         string
+		src          string
+		strict       bool
+		wantWarnings int
+		wantErr      bool
+	}{
+		{"clean", clean, false, 0, false},
+		{"clean strict", clean, true, 0, false},
+		{"warnings", warns, false, 2, false},
+		{"warnings strict", warns, true, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader, err := st.TranslateShaderWithOptions(tt.src, "fragment", ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{StrictWarnings: tt.strict})
+			if tt.wantErr {
+				var te *TranslateError
+				if !errors.As(err, &te) {
+					t.Fatalf("err = %v, want a *TranslateError", err)
+				}
+				if len(te.Diagnostics) != tt.wantWarnings || !strings.Contains(te.InfoLog, "mytool") || !strings.Contains(te.InfoLog, "othertool") {
+					t.Errorf("TranslateError = %+v, want both warnings", te)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(shader.Diagnostics) != tt.wantWarnings {
+				t.Errorf("Diagnostics = %v, want %d", shader.Diagnostics, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestUsesInstanceAndVertexID(t *testing.T) {
+	st := newTestTranslator(t)
+	tests := []struct {
+		name, expr           string
+		wantInstance, wantVx bool
+	}{
+		{"neither", "pos", false, false},
+		{"instance", "pos + float(gl_InstanceID)", true, false},
+		{"vertex", "pos + float(gl_VertexID)", false, true},
+		{"both", "pos + float(gl_InstanceID + gl_VertexID)", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := "#version 300 es\nin vec4 pos;\nvoid main() {\n    gl_Position = " + tt.expr + ";\n}\n"
+			for _, output := range []OutputFormat{OutputFormatESSL, OutputFormatGLSL330} {
+				shader := mustTranslate(t, st, src, "vertex", ShaderSpecGLES3, output, TranslateOptions{})
+				if shader.UsesInstanceID != tt.wantInstance || shader.UsesVertexID != tt.wantVx {
+					t.Errorf("%s: UsesInstanceID %v, UsesVertexID %v, want %v, %v",
+						output, shader.UsesInstanceID, shader.UsesVertexID, tt.wantInstance, tt.wantVx)
+				}
+			}
+		})
+	}
+}
+
+func TestDisableNameMapping(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 300 es
+precision mediump float;
+uniform vec4 averyveryverylonguniformnamethatkeepsgoing;
+in vec2 texture_coordinates_for_the_diffuse_layer;
+out vec4 final_fragment_color_output;
+void main() {
+    final_fragment_color_output = averyveryverylonguniformnamethatkeepsgoing * texture_coordinates_for_the_diffuse_layer.x;
+}
+`
+	for _, disable := range []bool{false, true} {
+		t.Run(strconv.FormatBool(disable), func(t *testing.T) {
+			shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{DisableNameMapping: disable})
+			for _, name := range []string{"averyveryverylonguniformnamethatkeepsgoing", "texture_coordinates_for_the_diffuse_layer", "final_fragment_color_output"} {
+				want := "_u" + name
+				if disable {
+					want = name
+				}
+				if got := shader.Variables[name].MappedName; got != want {
+					t.Errorf("MappedName of %s = %q, want %q", name, got, want)
+				}
+				if !regexp.MustCompile(`\b` + want + `\b`).MatchString(shader.Code) {
+					t.Errorf("Code lacks %q:\n%s", want, shader.Code)
+				}
+				if disable && strings.Contains(shader.Code, "_u"+name) {
+					t.Errorf("Code still has %q:\n%s", "_u"+name, shader.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestFitsResources(t *testing.T) {
+	st := newTestTranslator(t)
+	vertex := mustTranslate(t, st, `#version 300 es
+in vec4 pos;
+uniform mat4 mvp;
+uniform vec4 offset;
+uniform sampler2D heights;
+out vec4 a;
+out vec4 b;
+void main() {
+    a = texture(heights, pos.xy);
+    b = offset;
+    gl_Position = mvp * pos;
+}
+`, "vertex", ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{})
+	fragment := mustTranslate(t, st, `#version 300 es
+precision mediump float;
+uniform sampler2D s0;
+uniform sampler2D s1;
+uniform sampler2D s2;
+in vec4 a;
+out vec4 color;
+void main() {
+    color = a + texture(s0, a.xy) + texture(s1, a.xy) + texture(s2, a.xy);
+}
+`, "fragment", ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{})
+	tests := []struct {
+		name   string
+		shader *Shader
+		limits Resources
+		want   []string
+	}{
+		{"vertex no limits", vertex, Resources{}, nil},
+		{"vertex fits", vertex, Resources{MaxVertexAttribs: 1, MaxVertexUniformVectors: 5, MaxVaryingVectors: 2, MaxVertexTextureImageUnits: 1}, nil},
+		{"vertex over", vertex, Resources{MaxVertexUniformVectors: 4, MaxVaryingVectors: 1}, []string{
+			"uniform vectors: 5 exceeds MaxVertexUniformVectors 4",
+			"varying vectors: 2 exceeds MaxVaryingVectors 1",
+		}},
+		{"fragment over", fragment, Resources{MaxTextureImageUnits: 2, MaxCombinedTextureImageUnits: 2, MaxFragmentUniformVectors: 1}, []string{
+			"texture units: 3 exceeds MaxTextureImageUnits 2",
+			"texture units: 3 exceeds MaxCombinedTextureImageUnits 2",
+		}},
+		// vertex limits do not apply to a fragment shader
+		{"fragment vertex limits", fragment, Resources{MaxVertexTextureImageUnits: 1, MaxVertexUniformVectors: 1}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.shader.FitsResources(tt.limits); !slices.Equal(got, tt.want) {
+				t.Errorf("FitsResources() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFitsResourcesDrawBuffers(t *testing.T) {
+	st := newTestTranslator(t)
+	outputs := mustTranslate(t, st, `#version 300 es
+precision mediump float;
+layout(location = 0) out vec4 a;
+layout(location = 1) out vec4 b[2];
+void main() {
+    a = vec4(1.0);
+    b[0] = a;
+    b[1] = a;
+}
+`, "fragment", ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{})
+	// the module does not support GL_EXT_draw_buffers, so a shader
+	// writing gl_FragData[3] cannot be translated; build its result
+	fragData := &Shader{
+		Variables: map[string]ShaderVariable{
+			"gl_FragData": {Name: "gl_FragData", Category: categoryOutputVariables, Location: -1, ArraySizes: []uint{4}},
+		},
+		source:     "#extension GL_EXT_draw_buffers : require\nprecision mediump float;\nvoid main() {\n    gl_FragData[0] = vec4(0.0);\n    gl_FragData[3] = vec4(1.0);\n}\n",
+		shaderType: "fragment",
+	}
+	tests := []struct {
+		name   string
+		shader *Shader
+		limit  int
+		want   []string
+	}{
+		{"outputs fit", outputs, 3, nil},
+		{"outputs over", outputs, 2, []string{"draw buffers: 3 exceeds MaxDrawBuffers 2"}},
+		{"gl_FragData fits", fragData, 4, nil},
+		{"gl_FragData over", fragData, 2, []string{"draw buffers: 4 exceeds MaxDrawBuffers 2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.shader.FitsResources(Resources{MaxDrawBuffers: tt.limit}); !slices.Equal(got, tt.want) {
+				t.Errorf("FitsResources() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtensionBehaviors(t *testing.T) {
+	st := newTestTranslator(t)
+	src := "#version 310 es\nprecision mediump float;\nout vec4 color;\nvoid main() {\n    color = vec4(1.0);\n}\n"
+	tests := []struct {
+		extension   string
+		behavior    ExtensionBehavior
+		wantErr     bool
+		wantWarning bool
+	}{
+		// the module supports GL_EXT_geometry_shader under GLES 3.1
+		{"GL_EXT_geometry_shader", ExtensionRequire, false, false},
+		{"GL_EXT_geometry_shader", ExtensionEnable, false, false},
+		{"GL_EXT_geometry_shader", ExtensionWarn, false, false},
+		{"GL_EXT_geometry_shader", ExtensionDisable, false, false},
+		{"GL_EXT_gpu_shader5", ExtensionRequire, true, false},
+		{"GL_EXT_gpu_shader5", ExtensionEnable, false, true},
+		{"GL_EXT_gpu_shader5", ExtensionWarn, false, true},
+		{"GL_EXT_gpu_shader5", ExtensionDisable, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.extension+"/"+string(tt.behavior), func(t *testing.T) {
+			opts := TranslateOptions{Extensions: map[string]ExtensionBehavior{tt.extension: tt.behavior}}
+			shader, err := st.TranslateShaderWithOptions(src, "fragment", ShaderSpecGLES31, OutputFormatESSL, opts)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "'"+tt.extension+"' : extension is not supported") {
+					t.Errorf("err = %v, want an unsupported extension error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(shader.Warnings, "extension is not supported"); got != tt.wantWarning {
+				t.Errorf("Warnings = %q, want a warning: %v", shader.Warnings, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestForceVersion(t *testing.T) {
+	st := newTestTranslator(t)
+	src := "#version 300 es\nin vec4 pos;\nvoid main() {\n    gl_Position = pos;\n}\n"
+	tests := []struct {
+		name        string
+		output      OutputFormat
+		profile     GLSLProfile
+		version     int
+		want        string
+		wantWarning string
+	}{
+		{"glsl newer", OutputFormatGLSL330, GLSLProfileDefault, 410, "#version 410", ""},
+		{"glsl keeps profile", OutputFormatGLSL330, GLSLProfileCore, 450, "#version 450 core", ""},
+		{"glsl older", OutputFormatGLSL330, GLSLProfileDefault, 150, "#version 150", "forced version 150 is older than version 330 the code was generated for"},
+		{"glsl unknown", OutputFormatGLSL330, GLSLProfileDefault, 340, "#version 340", "forced version 340 is not a GLSL version"},
+		{"glsl adds directive", OutputFormatGLSL, GLSLProfileDefault, 120, "#version 120", ""},
+		{"essl keeps es", OutputFormatESSL, GLSLProfileDefault, 310, "#version 310 es", ""},
+		{"essl unknown", OutputFormatESSL, GLSLProfileDefault, 330, "#version 330 es", "forced version 330 is not a GLSL ES version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := mustTranslate(t, st, src, "vertex", ShaderSpecGLES3, tt.output, TranslateOptions{Profile: tt.profile})
+			shader := mustTranslate(t, st, src, "vertex", ShaderSpecGLES3, tt.output, TranslateOptions{Profile: tt.profile, ForceVersion: tt.version})
+			first, rest, _ := strings.Cut(shader.Code, "\n")
+			if first != tt.want {
+				t.Errorf("directive = %q, want %q", first, tt.want)
+			}
+			// every other line is left as it was
+			plainRest := plain.Code
+			if strings.HasPrefix(plainRest, "#version") {
+				_, plainRest, _ = strings.Cut(plainRest, "\n")
+			}
+			if rest != plainRest {
+				t.Errorf("Code after the directive changed:\n%s\nwant:\n%s", rest, plainRest)
+			}
+			var warnings []string
+			for _, d := range shader.Diagnostics {
+				warnings = append(warnings, d.Message)
+			}
+			if tt.wantWarning == "" && len(warnings) > 0 || tt.wantWarning != "" && !slices.Contains(warnings, tt.wantWarning) {
+				t.Errorf("Diagnostics = %q, want %q", warnings, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	src := "#version 300 es\nin vec4 pos;\nvoid main() {\n    gl_Position = pos;\n}\n"
+	tests := []struct {
+		name    string
+		opts    []TranslatorOption
+		wantErr bool
+	}{
+		{"default", nil, false},
+		{"large", []TranslatorOption{WithMaxResponseSize(1 << 20)}, false},
+		{"small", []TranslatorOption{WithMaxResponseSize(64)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newTestTranslator(t, tt.opts...)
+			_, err := st.TranslateShader(src, "vertex", ShaderSpecGLES3, OutputFormatGLSL330)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr && (!errors.Is(err, ErrProtocol) || !strings.Contains(err.Error(), "exceeds the maximum size of 64 bytes")) {
+				t.Errorf("err = %v, want ErrProtocol for the size limit", err)
+			}
+		})
+	}
+
+	// a response of exactly the limit is read; one byte more is not
+	st := newTestTranslator(t, WithMaxResponseSize(16))
+	for _, n := range []int{16, 17} {
+		results, err := st.malloc.Call(st.ctx, uint64(n)+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ptr := uint32(results[0])
+		st.module.Memory().Write(ptr, append([]byte(strings.Repeat("x", n)), 0))
+		got, err := st.readStringFromMemory(ptr)
+		if n <= 16 && (err != nil || len(got) != n) {
+			t.Errorf("%d bytes: got %d bytes, err %v", n, len(got), err)
+		}
+		if n > 16 && !errors.Is(err, ErrProtocol) {
+			t.Errorf("%d bytes: err = %v, want ErrProtocol", n, err)
+		}
+		st.free.Call(st.ctx, uint64(ptr))
+	}
+}
+
+func TestWithModuleName(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []TranslatorOption
+		want string
+	}{
+		{"default", nil, "angle"},
+		{"empty", []TranslatorOption{WithModuleName("")}, "angle"},
+		{"named", []TranslatorOption{WithModuleName("angle-worker-3")}, "angle-worker-3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newTestTranslator(t, tt.opts...)
+			if got := st.module.Name(); got != tt.want {
+				t.Errorf("module name = %q, want %q", got, tt.want)
+			}
+			if got := st.Config().ModuleName; got != tt.want {
+				t.Errorf("Config().ModuleName = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEarlyFragmentTests(t *testing.T) {
+	st := newTestTranslator(t)
+	body := "precision mediump float;\nout vec4 color;\nvoid main() {\n    color = vec4(1.0);\n}\n"
+	tests := []struct {
+		name, src string
+		output    OutputFormat
+		want      bool
+	}{
+		{"declared essl", "#version 310 es\nlayout(early_fragment_tests) in;\n" + body, OutputFormatESSL, true},
+		{"declared glsl", "#version 310 es\nlayout(early_fragment_tests) in;\n" + body, OutputFormatGLSL450, true},
+		{"absent", "#version 310 es\n" + body, OutputFormatESSL, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader := mustTranslate(t, st, tt.src, "fragment", ShaderSpecGLES31, tt.output, TranslateOptions{})
+			if shader.EarlyFragmentTests != tt.want {
+				t.Errorf("EarlyFragmentTests = %v, want %v", shader.EarlyFragmentTests, tt.want)
+			}
+			if got := strings.Contains(shader.Code, "early_fragment_tests"); got != tt.want {
+				t.Errorf("Code keeps the layout: %v, want %v:\n%s", got, tt.want, shader.Code)
+			}
+		})
+	}
+}
+
+func TestMatrixLayout(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 300 es
+layout(std140) uniform B {
+    mat4 m;
+    layout(column_major) mat3 c;
+    vec4 v;
+};
+uniform mat4 plain;
+in vec4 pos;
+void main() {
+    gl_Position = m * pos + plain * pos + vec4(c[0], 0.0) + v;
+}
+`
+	tests := []struct {
+		layout   MatrixLayout
+		rowMajor map[string]bool
+		want     string
+	}{
+		{MatrixLayoutDefault, map[string]bool{"m": false, "c": false, "v": false}, "layout(column_major) mat4 _um;"},
+		{MatrixLayoutRowMajor, map[string]bool{"m": true, "c": false, "v": false}, "layout(row_major) mat4 _um;"},
+		{MatrixLayoutColumnMajor, map[string]bool{"m": false, "c": false, "v": false}, "layout(column_major) mat4 _um;"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.layout), func(t *testing.T) {
+			shader := mustTranslate(t, st, src, "vertex", ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{MatrixLayout: tt.layout})
+			for _, f := range blockByName(t, shader, "B").Fields {
+				if f.IsRowMajor != tt.rowMajor[f.Name] {
+					t.Errorf("%s.IsRowMajor = %v, want %v", f.Name, f.IsRowMajor, tt.rowMajor[f.Name])
+				}
+			}
+			// the member qualifier wins, and default-block uniforms stay column-major
+			for _, want := range []string{tt.want, "layout(column_major) mat3 _uc;", "uniform mat4 _uplain;"} {
+				if !strings.Contains(shader.Code, want) {
+					t.Errorf("Code lacks %q:\n%s", want, shader.Code)
+				}
+			}
+			if shader.Variables["plain"].IsRowMajor {
+				t.Error("default-block uniform plain is row-major")
+			}
+		})
+	}
+}
+
+func TestNewShaderTranslatorWithAutoClose(t *testing.T) {
+	src := "#version 300 es\nin vec4 pos;\nvoid main() {\n    gl_Position = pos;\n}\n"
+	tests := []struct {
+		name       string
+		closeFirst bool
+	}{
+		{"cancel", false},
+		{"close then cancel", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			st, err := NewShaderTranslatorWithAutoClose(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := st.TranslateShader(src, "vertex", ShaderSpecGLES3, OutputFormatGLSL330); err != nil {
+				t.Fatalf("TranslateShader before cancel: %v", err)
+			}
+			if tt.closeFirst {
+				if err := st.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cancel()
+			for !st.module.IsClosed() {
+				runtime.Gosched()
+			}
+			if _, err := st.TranslateShader(src, "vertex", ShaderSpecGLES3, OutputFormatGLSL330); !errors.Is(err, ErrClosed) {
+				t.Errorf("TranslateShader after cancel: err = %v, want ErrClosed", err)
+			}
+			if err := st.Close(); err != nil {
+				t.Errorf("Close after cancel: %v", err)
+			}
+		})
+	}
+}
+
+func TestBindingConflicts(t *testing.T) {
+	st := newTestTranslator(t)
+	head := "#version 310 es\nprecision mediump float;\nout vec4 color;\n"
+	tests := []struct {
+		name string
+		decl string
+		use  string
+		want []string
+	}{
+		{"distinct", "layout(binding = 0) uniform sampler2D a;\nlayout(binding = 1) uniform sampler2D b;\n",
+			"texture(a, vec2(0.0)) + texture(b, vec2(0.0))", nil},
+		{"double-bound samplers", "layout(binding = 0) uniform sampler2D diffuse;\nlayout(binding = 0) uniform sampler2D normals;\n",
+			"texture(diffuse, vec2(0.0)) + texture(normals, vec2(0.0))", []string{`texture unit 0: "diffuse" and "normals"`}},
+		{"array overlap", "layout(binding = 0) uniform sampler2D arr[3];\nlayout(binding = 2) uniform sampler2D last;\n",
+			"texture(arr[0], vec2(0.0)) + texture(last, vec2(0.0))", []string{`texture unit 2: "last" and "arr"`}},
+		{"separate spaces", "layout(binding = 0) uniform sampler2D s;\nlayout(binding = 0, rgba8) uniform readonly highp image2D img;\nlayout(std140, binding = 0) uniform U { vec4 u; };\nlayout(std430, binding = 0) buffer B { vec4 b; };\n",
+			"texture(s, vec2(0.0)) + imageLoad(img, ivec2(0)) + u + b", nil},
+		{"blocks", "layout(std140, binding = 1) uniform U1 { vec4 u1; };\nlayout(std140, binding = 1) uniform U2 { vec4 u2; };\n",
+			"u1 + u2", []string{`uniform buffer binding 1: "U1" and "U2"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := head + tt.decl + "void main() {\n    color = " + tt.use + ";\n}\n"
+			shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+			if got := shader.BindingConflicts(); !slices.Equal(got, tt.want) {
+				t.Errorf("BindingConflicts() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryQualifiers(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 310 es
+precision mediump float;
+layout(binding = 0, rgba8) uniform readonly highp image2D src;
+layout(binding = 1, rgba8) uniform writeonly restrict highp image2D dst;
+layout(std430, binding = 0) coherent buffer Data {
+    vec4 shared_value;
+    volatile vec4 flag;
+    readonly vec4 constant;
+};
+layout(std430, binding = 1) buffer Plain {
+    vec4 plain;
+};
+out vec4 color;
+void main() {
+    imageStore(dst, ivec2(0), imageLoad(src, ivec2(0)));
+    shared_value = flag + constant + plain;
+    color = shared_value;
+}
+`
+	shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+	images := map[string]MemoryQualifiers{}
+	for _, img := range shader.Reflect().Images {
+		images[img.Name] = img.MemoryQualifiers
+	}
+	members := map[string]MemoryQualifiers{}
+	for _, name := range []string{"Data", "Plain"} {
+		for _, f := range blockByName(t, shader, name).Fields {
+			members[f.Name] = f.MemoryQualifiers
+		}
+	}
+	tests := []struct {
+		name string
+		got  MemoryQualifiers
+		want MemoryQualifiers
+	}{
+		{"src", images["src"], MemoryReadonly},
+		{"dst", images["dst"], MemoryWriteonly | MemoryRestrict},
+		// members inherit the block's coherent
+		{"shared_value", members["shared_value"], MemoryCoherent},
+		{"flag", members["flag"], MemoryCoherent | MemoryVolatile},
+		{"constant", members["constant"], MemoryCoherent | MemoryReadonly},
+		{"plain", members["plain"], 0},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: MemoryQualifiers = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestSkipActiveVariables(t *testing.T) {
+	st := newTestTranslator(t)
+	src := "#version 300 es\nprecision mediump float;\nuniform vec4 tint;\nlayout(std140) uniform B { vec4 b; };\nout vec4 color;\nvoid main() {\n    color = tint + b;\n}\n"
+	tests := []struct {
+		name    string
+		opts    TranslateOptions
+		wantErr bool
+	}{
+		{"collected", TranslateOptions{}, false},
+		{"skipped", TranslateOptions{SkipActiveVariables: true}, false},
+		{"with RemoveUniforms", TranslateOptions{SkipActiveVariables: true, RemoveUniforms: []string{"tint"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader, err := st.TranslateShaderWithOptions(src, "fragment", ShaderSpecGLES3, OutputFormatGLSL330, tt.opts)
+			if tt.wantErr {
+				if !errors.Is(err, ErrValidation) {
+					t.Errorf("err = %v, want ErrValidation", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(shader.Code, "uniform vec4 _utint;") || !strings.Contains(shader.Code, "void main()") {
+				t.Errorf("Code:\n%s", shader.Code)
+			}
+			skipped := tt.opts.SkipActiveVariables
+			if (len(shader.Variables) == 0) != skipped || (len(shader.Blocks) == 0) != skipped {
+				t.Errorf("%d variables and %d blocks, want none: %v", len(shader.Variables), len(shader.Blocks), skipped)
+			}
+		})
+	}
+}
+
+func TestReflectionDiff(t *testing.T) {
+	st := newTestTranslator(t)
+	base := `#version 310 es
+precision mediump float;
+layout(binding = 0) uniform sampler2D tex;
+uniform vec4 tint;
+layout(std140, binding = 0) uniform B {
+    vec4 a;
+    vec4 b;
+};
+out vec4 color;
+void main() {
+    color = texture(tex, vec2(0.0)) + tint + a + b;
+}
+`
+	tests := []struct {
+		name string
+		old  string
+		new  string
+		want []string
+	}{
+		{"same", "", "", nil},
+		{"added uniform", "uniform vec4 tint;\n", "uniform vec4 tint;\nuniform float gain;\n", []string{`uniform "gain": added`}},
+		{"changed binding", "layout(binding = 0) uniform sampler2D tex;", "layout(binding = 1) uniform sampler2D tex;", []string{`uniform "tex": binding 0 -> 1`}},
+		{"inserted member", "    vec4 a;\n", "    vec4 a;\n    vec4 extra;\n", []string{
+			`uniform block "B": data size 32 -> 48`,
+			`uniform block member "B.b": offset 16 -> 32`,
+			`uniform block member "B.extra": added`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := mustTranslate(t, st, base, "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+			// unused uniforms and block members are still reported
+			new := mustTranslate(t, st, strings.Replace(base, tt.old, tt.new, 1), "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+			if got := ReflectionDiff(old, new); !slices.Equal(got, tt.want) {
+				t.Errorf("ReflectionDiff() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinGLVersion(t *testing.T) {
+	st := newTestTranslator(t)
+	compute := "#version 310 es\nlayout(local_size_x = 8) in;\nlayout(std430, binding = 0) buffer B { float v[]; };\nvoid main() {\n    v[gl_GlobalInvocationID.x] = 1.0;\n}\n"
+	fragment := "#version 300 es\nprecision mediump float;\nout vec4 color;\nvoid main() {\n    color = vec4(1.0);\n}\n"
+	tests := []struct {
+		name, src, shaderType string
+		spec, min             ShaderSpec
+		wantErr               bool
+	}{
+		{"3.1 feature", compute, "compute", ShaderSpecGLES31, "", false},
+		{"3.1 feature capped at 3.0", compute, "compute", ShaderSpecGLES31, ShaderSpecGLES3, true},
+		{"3.1 feature capped at webgl 2", compute, "compute", ShaderSpecWebGL3, ShaderSpecGLES3, true},
+		{"newer minimum has no effect", compute, "compute", ShaderSpecGLES31, ShaderSpecGLES32, false},
+		{"3.0 shader capped at 3.0", fragment, "fragment", ShaderSpecGLES31, ShaderSpecGLES3, false},
+		{"3.0 shader capped at 2.0", fragment, "fragment", ShaderSpecGLES31, ShaderSpecGLES2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := st.TranslateShaderWithOptions(tt.src, tt.shaderType, tt.spec, OutputFormatESSL, TranslateOptions{MinGLVersion: tt.min})
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "unsupported shader version") {
+				t.Errorf("err = %v, want an unsupported version error", err)
+			}
+		})
+	}
+}
+
+func TestSupportsOutputAndSpec(t *testing.T) {
+	st := newTestTranslator(t)
+	outputs := []struct {
+		output OutputFormat
+		want   bool
+	}{
+		{OutputFormatESSL, true},
+		{OutputFormatGLSL, true},
+		{OutputFormatGLSL130, true},
+		{OutputFormatGLSL330, true},
+		{OutputFormatGLSL450, true},
+		// the embedded module has no other backends
+		{"spirv", false},
+		{"hlsl11", false},
+		{"msl", false},
+	}
+	for _, tt := range outputs {
+		if got := st.SupportsOutput(tt.output); got != tt.want {
+			t.Errorf("SupportsOutput(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+	specs := []struct {
+		spec ShaderSpec
+		want bool
+	}{
+		{ShaderSpecGLES2, true},
+		{ShaderSpecGLES3, true},
+		{ShaderSpecGLES31, true},
+		{ShaderSpecGLES32, true},
+		{ShaderSpecWebGL, true},
+		{ShaderSpecWebGL2, true},
+		{ShaderSpecWebGL3, true},
+		{ShaderSpecWebGLN, true},
+		{"gles4", false},
+	}
+	for _, tt := range specs {
+		if got := st.SupportsSpec(tt.spec); got != tt.want {
+			t.Errorf("SupportsSpec(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+
+	st.Close()
+	if st.SupportsOutput(OutputFormatESSL) || st.SupportsSpec(ShaderSpecGLES2) {
+		t.Error("a closed translator reports support")
+	}
+}
+
+func TestBlockSizeBytes(t *testing.T) {
+	st := newTestTranslator(t)
+	layouts := mustTranslate(t, st, layoutSource, "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+	known := mustTranslate(t, st, `#version 310 es
+precision mediump float;
+layout(std140) uniform K140 { vec3 a; float b; mat4 m; vec2 arr[3]; } k140;
+layout(std430) buffer K430 { vec3 a; float b; mat4 m; vec2 arr[3]; } k430;
+layout(std430) buffer Tail { vec4 head; float tail[]; } tail;
+layout(std140) uniform Inst { vec3 v; } inst[4];
+out vec4 color;
+void main() {
+    color = vec4(k140.a, k140.b) + k140.m[0] + vec4(k140.arr[2], 0.0, 0.0)
+        + vec4(k430.a, k430.b) + k430.m[0] + vec4(k430.arr[2], 0.0, 0.0)
+        + tail.head + vec4(tail.tail[0]) + vec4(inst[3].v, 0.0);
+}
+`, "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+	tests := []struct {
+		shader *Shader
+		block  string
+		want   int
+	}{
+		{layouts, "A", 160},
+		{layouts, "C", 96},
+		{layouts, "S", 112},
+		{layouts, "Sh", 0},
+		// vec2 array elements take 16 bytes in std140 and 8 in std430
+		{known, "K140", 128},
+		{known, "K430", 112},
+		// the runtime-sized array is not counted
+		{known, "Tail", 16},
+		// the size of one instance
+		{known, "Inst", 16},
+	}
+	for _, tt := range tests {
+		if got := blockByName(t, tt.shader, tt.block).SizeBytes(); got != tt.want {
+			t.Errorf("%s.SizeBytes() = %d, want %d", tt.block, got, tt.want)
+		}
+	}
+}
+
+func TestSynthesizedFragOutput(t *testing.T) {
+	st := newTestTranslator(t)
+	fragColor := "precision mediump float;\nvoid main() {\n    gl_FragColor = vec4(1.0);\n}\n"
+	fragData := "precision mediump float;\nvoid main() {\n    gl_FragData[0] = vec4(1.0);\n}\n"
+	tests := []struct {
+		name, src, builtin string
+		output             OutputFormat
+		outName            string
+		wantMapped         string
+		wantDecl           string
+	}{
+		{"gl_FragColor", fragColor, "gl_FragColor", OutputFormatGLSL330, "", "webgl_FragColor", "out vec4 webgl_FragColor;"},
+		{"gl_FragColor renamed", fragColor, "gl_FragColor", OutputFormatGLSL330, "outColor", "outColor", "out vec4 outColor;"},
+		{"gl_FragData", fragData, "gl_FragData", OutputFormatGLSL330, "", "webgl_FragData", "out vec4 webgl_FragData[1];"},
+		{"gl_FragData renamed", fragData, "gl_FragData", OutputFormatGLSL330, "outColor", "outColor", "out vec4 outColor[1];"},
+		// outputs that keep the built-in declare nothing
+		{"essl", fragColor, "gl_FragColor", OutputFormatESSL, "outColor", "gl_FragColor", "gl_FragColor = "},
+		{"glsl 1.10", fragColor, "gl_FragColor", OutputFormatGLSL, "outColor", "gl_FragColor", "gl_FragColor = "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader := mustTranslate(t, st, tt.src, "fragment", ShaderSpecGLES2, tt.output, TranslateOptions{FragOutputName: tt.outName})
+			if got := shader.Variables[tt.builtin].MappedName; got != tt.wantMapped {
+				t.Errorf("MappedName of %s = %q, want %q", tt.builtin, got, tt.wantMapped)
+			}
+			if !strings.Contains(shader.Code, tt.wantDecl) {
+				t.Errorf("Code lacks %q:\n%s", tt.wantDecl, shader.Code)
+			}
+			if got := shader.FragmentOutputMapping(); !reflect.DeepEqual(got, map[string]int{tt.builtin: 0}) {
+				t.Errorf("FragmentOutputMapping() = %v, want %s at 0", got, tt.builtin)
+			}
+		})
+	}
+
+	if _, err := st.TranslateShaderWithOptions(fragColor, "fragment", ShaderSpecGLES2, OutputFormatGLSL330, TranslateOptions{FragOutputName: "2bad"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("invalid FragOutputName: err = %v, want ErrValidation", err)
+	}
+}
+
+func TestParseErrorResponses(t *testing.T) {
+	tests := []struct {
+		name        string
+		resp        string
+		wantCode    int
+		wantMessage string
+		wantLog     string
+		wantIs      error
+	}{
+		{"with info_log", `{"jsonrpc":"2.0","id":1,"error":{"code":2,"message":"Shader compilation failed.","data":{"info_log":"ERROR: 0:3: 'x' : undeclared identifier\n"}}}`,
+			errorCodeCompile, "Shader compilation failed.", "ERROR: 0:3: 'x' : undeclared identifier\n", ErrCompile},
+		{"missing data", `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"Invalid params"}}`,
+			-32602, "Invalid params", "", ErrValidation},
+		{"null data", `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"Invalid params","data":null}}`,
+			-32602, "Invalid params", "", ErrValidation},
+		{"missing info_log", `{"jsonrpc":"2.0","id":1,"error":{"code":2,"message":"Shader compilation failed.","data":{}}}`,
+			errorCodeCompile, "Shader compilation failed.", "", ErrCompile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseShaderResponse([]byte(tt.resp))
+			var te *TranslateError
+			if !errors.As(err, &te) {
+				t.Fatalf("err = %v, want a *TranslateError", err)
+			}
+			if te.Code != tt.wantCode || te.Message != tt.wantMessage || te.InfoLog != tt.wantLog {
+				t.Errorf("TranslateError = %+v", te)
+			}
+			if !errors.Is(err, tt.wantIs) {
+				t.Errorf("err does not wrap %v", tt.wantIs)
+			}
+			if (tt.wantLog != "") != (len(te.Diagnostics) > 0) {
+				t.Errorf("Diagnostics = %v for info log %q", te.Diagnostics, te.InfoLog)
+			}
+		})
+	}
+
+	// a data member of the wrong shape is a protocol error
+	if _, err := ParseShaderResponse([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":2,"message":"m","data":{"info_log":5}}}`)); !errors.Is(err, ErrProtocol) {
+		t.Errorf("malformed data: err = %v, want ErrProtocol", err)
+	}
+}
+
+func TestMaxTextureUnit(t *testing.T) {
+	st := newTestTranslator(t)
+	tests := []struct {
+		name string
+		decl string
+		use  string
+		want int
+	}{
+		{"none", "uniform vec4 tint;\n", "tint", -1},
+		{"bound", "layout(binding = 1) uniform sampler2D a;\nlayout(binding = 4) uniform sampler2D b;\n",
+			"texture(a, vec2(0.0)) + texture(b, vec2(0.0))", 4},
+		{"bound array", "layout(binding = 2) uniform sampler2D arr[3];\nlayout(binding = 0) uniform sampler2D a;\n",
+			"texture(arr[0], vec2(0.0)) + texture(a, vec2(0.0))", 4},
+		// unbound samplers fill the holes below the bound ones
+		{"unbound fill holes", "layout(binding = 3) uniform sampler2D a;\nuniform sampler2D b;\nuniform sampler2D c[2];\n",
+			"texture(a, vec2(0.0)) + texture(b, vec2(0.0)) + texture(c[1], vec2(0.0))", 3},
+		{"unbound past bound", "layout(binding = 1) uniform sampler2D a;\nuniform sampler2D b[3];\n",
+			"texture(a, vec2(0.0)) + texture(b[0], vec2(0.0))", 4},
+		// b skips unit 0, which d still gets
+		{"unbound first fit", "layout(binding = 1) uniform sampler2D a;\nuniform sampler2D b[2];\nuniform sampler2D d[1];\n",
+			"texture(a, vec2(0.0)) + texture(b[1], vec2(0.0)) + texture(d[0], vec2(0.0))", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := "#version 310 es\nprecision mediump float;\n" + tt.decl + "out vec4 color;\nvoid main() {\n    color = " + tt.use + ";\n}\n"
+			shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+			if got := shader.MaxTextureUnit(); got != tt.want {
+				t.Errorf("MaxTextureUnit() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranslateWithReflectionJSONIsDeterministic(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("#version 310 es\nprecision mediump float;\n")
+	for i := 0; i < 16; i++ {
+		fmt.Fprintf(&b, "uniform vec4 u%d;\nlayout(binding = %d) uniform sampler2D s%d;\n", i, i, i)
+	}
+	b.WriteString("layout(std140) uniform B { mat3 m; vec4 v; };\nout vec4 color;\nvoid main() {\n    color = v + vec4(m[0], 0.0)")
+	for i := 0; i < 16; i++ {
+		fmt.Fprintf(&b, " + u%d + texture(s%d, vec2(0.0))", i, i)
+	}
+	b.WriteString(";\n}\n")
+	src := b.String()
+
+	var first []byte
+	for run := 0; run < 3; run++ {
+		// a fresh translator each run, so nothing is shared between them
+		st := newTestTranslator(t)
+		for i := 0; i < 3; i++ {
+			code, reflectionJSON, err := st.TranslateWithReflectionJSON(src, "fragment", ShaderSpecGLES31, OutputFormatGLSL450, TranslateOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first == nil {
+				first = reflectionJSON
+				shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES31, OutputFormatGLSL450, TranslateOptions{})
+				if code != shader.Code {
+					t.Errorf("code differs from TranslateShaderWithOptions")
+				}
+				var decoded Reflection
+				if err := json.Unmarshal(reflectionJSON, &decoded); err != nil || !reflect.DeepEqual(decoded, shader.Reflect()) {
+					t.Errorf("JSON does not decode to Reflect(): %v", err)
+				}
+				continue
+			}
+			if string(reflectionJSON) != string(first) {
+				t.Fatalf("run %d.%d: reflection JSON differs:\n%s\nwant:\n%s", run, i, reflectionJSON, first)
+			}
+		}
+	}
+}
+
+func TestFitsResourcesUniformBufferBindings(t *testing.T) {
+	st := newTestTranslator(t)
+	// three blocks, one of them an array of two, and a storage block that
+	// does not count
+	src := `#version 310 es
+precision mediump float;
+layout(std140) uniform A { vec4 a; };
+layout(std140) uniform B { vec4 b; };
+layout(std140) uniform I { vec4 i; } inst[2];
+layout(std430) buffer S { vec4 s; };
+out vec4 color;
+void main() {
+    color = a + b + inst[1].i + s;
+}
+`
+	shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+	if got := shader.UniformBlockCount(); got != 4 {
+		t.Errorf("UniformBlockCount() = %d, want 4", got)
+	}
+	tests := []struct {
+		limit int
+		want  []string
+	}{
+		{0, nil},
+		{4, nil},
+		{3, []string{"uniform blocks: 4 exceeds MaxUniformBufferBindings 3"}},
+	}
+	for _, tt := range tests {
+		if got := shader.FitsResources(Resources{MaxUniformBufferBindings: tt.limit}); !slices.Equal(got, tt.want) {
+			t.Errorf("limit %d: FitsResources() = %q, want %q", tt.limit, got, tt.want)
+		}
+	}
+
+	// the limit is an offline check only, so it is not sent to the module
+	if _, err := st.TranslateShaderWithOptions(src, "fragment", ShaderSpecGLES31, OutputFormatESSL,
+		TranslateOptions{Resources: &Resources{MaxUniformBufferBindings: 1}}); err != nil {
+		t.Errorf("translation with MaxUniformBufferBindings 1: %v", err)
+	}
+	if data, _ := json.Marshal(Resources{MaxUniformBufferBindings: 1}); string(data) != "{}" {
+		t.Errorf("Resources marshals to %s, want {}", data)
+	}
+}
+
+func TestSourceNormalization(t *testing.T) {
+	st := newTestTranslator(t)
+	src := "#version 300 es\nprecision mediump float;\nout vec4 color;\nvoid main() {\n    color = vec4(1.0);\n}\n"
+	broken := strings.Replace(src, "vec4(1.0)", "undeclared", 1)
+	tests := []struct {
+		name string
+		edit func(string) string
+	}{
+		{"lf", func(s string) string { return s }},
+		{"bom", func(s string) string { return "\ufeff" + s }},
+		{"crlf", func(s string) string { return strings.ReplaceAll(s, "\n", "\r\n") }},
+		{"cr", func(s string) string { return strings.ReplaceAll(s, "\n", "\r") }},
+		{"bom and crlf", func(s string) string { return "\ufeff" + strings.ReplaceAll(s, "\n", "\r\n") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader := mustTranslate(t, st, tt.edit(src), "fragment", ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{})
+			if !strings.HasPrefix(shader.Code, "#version 300 es\n") || strings.Contains(shader.Code, "\r") {
+				t.Errorf("Code:\n%q", shader.Code)
+			}
+			// errors still report the right line
+			_, err := st.TranslateShader(tt.edit(broken), "fragment", ShaderSpecGLES3, OutputFormatESSL)
+			if err == nil || !strings.Contains(err.Error(), "0:5: 'undeclared'") {
+				t.Errorf("err = %v, want an error on line 5", err)
+			}
+		})
+	}
+
+	// RawSource sends the BOM to the module, which cannot handle it
+	if _, err := st.TranslateShaderWithOptions("\ufeff"+src, "fragment", ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{RawSource: true}); err == nil {
+		t.Error("RawSource translated a source with a byte order mark")
+	}
+}
+
+func TestObserverStages(t *testing.T) {
+	var mu sync.Mutex
+	var stages []string
+	st := newTestTranslator(t, WithObserver(func(stage string, d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		if d < 0 {
+			t.Errorf("stage %s took %v", stage, d)
+		}
+		stages = append(stages, stage)
+	}))
+	all := []string{StageWrite, StageInvoke, StageRead, StageDecode, StageFree}
+	tests := []struct {
+		name, src string
+		wantErr   bool
+	}{
+		{"success", "void main() {\n    gl_Position = vec4(0.0);\n}\n", false},
+		// a rejected shader still goes through every stage
+		{"compile error", "void main() {\n    gl_Position = undeclared;\n}\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			stages = nil
+			mu.Unlock()
+			_, err := st.TranslateShader(tt.src, "vertex", ShaderSpecGLES2, OutputFormatESSL)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("err = %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Equal(stages, all) {
+				t.Errorf("stages = %q, want %q", stages, all)
+			}
+		})
+	}
+}
+
+func TestCheckPipeline(t *testing.T) {
+	st := newTestTranslator(t)
+	vertex := func(outs string) *Shader {
+		src := "#version 310 es\nin vec4 pos;\n" + outs + "void main() {\n    gl_Position = pos;\n}\n"
+		return mustTranslate(t, st, src, "vertex", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+	}
+	fragment := func(ins string) *Shader {
+		src := "#version 310 es\nprecision mediump float;\n" + ins + "out vec4 color;\nvoid main() {\n    color = vec4(1.0);\n}\n"
+		return mustTranslate(t, st, src, "fragment", ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{})
+	}
+	tests := []struct {
+		name   string
+		vs, fs string
+		want   []string
+	}{
+		{"names differ, locations match", "layout(location = 0) out vec4 outColor;\nlayout(location = 1) out vec2 outUV;\n",
+			"layout(location = 0) in vec4 tint;\nlayout(location = 1) in vec2 uv;\n", nil},
+		{"location mismatch", "layout(location = 0) out vec4 color0;\n",
+			"layout(location = 1) in vec4 color0;\n", []string{`fragment input "color0" (location 1): no vertex output at location 1`}},
+		{"type mismatch", "layout(location = 0) out vec4 color0;\n",
+			"layout(location = 0) in vec3 tint;\n", []string{`location 0: vertex output "color0" has type 0x8B52, fragment input "tint" has type 0x8B51`}},
+		{"by name", "out vec4 shade;\n", "in vec4 shade;\n", nil},
+		{"missing name", "out vec4 shade;\n", "in vec4 other;\n", []string{`fragment input "other": no vertex output "other" without a location`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stages := map[ShaderType]*Shader{ShaderTypeVertex: vertex(tt.vs), ShaderTypeFragment: fragment(tt.fs)}
+			if got := CheckPipeline(stages); !slices.Equal(got, tt.want) {
+				t.Errorf("CheckPipeline() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestESSLVersion(t *testing.T) {
+	st := newTestTranslator(t)
+	essl100 := "void main() {\n    gl_Position = vec4(0.0);\n}\n"
+	essl300 := "#version 300 es\nvoid main() {\n    gl_Position = vec4(0.0);\n}\n"
+	tests := []struct {
+		name    string
+		src     string
+		spec    ShaderSpec
+		output  OutputFormat
+		opts    TranslateOptions
+		want    string
+		wantErr bool
+	}{
+		{"100", essl100, ShaderSpecGLES2, OutputFormatESSL, TranslateOptions{ESSLVersion: 100}, "#version 100\n", false},
+		{"300", essl300, ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{ESSLVersion: 300}, "#version 300 es\n", false},
+		{"300 raised to 310", essl300, ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{ESSLVersion: 310}, "#version 310 es\n", false},
+		{"300 raised to 320", essl300, ShaderSpecGLES32, OutputFormatESSL, TranslateOptions{ESSLVersion: 320}, "#version 320 es\n", false},
+		{"newer than the spec", essl300, ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{ESSLVersion: 310}, "", true},
+		{"newer than MinGLVersion", essl300, ShaderSpecGLES31, OutputFormatESSL, TranslateOptions{ESSLVersion: 310, MinGLVersion: ShaderSpecGLES3}, "", true},
+		{"100 raised", essl100, ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{ESSLVersion: 300}, "", true},
+		{"300 lowered", essl300, ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{ESSLVersion: 100}, "", true},
+		{"not a version", essl300, ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{ESSLVersion: 330}, "", true},
+		{"not ESSL output", essl300, ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{ESSLVersion: 300}, "", true},
+		{"with ForceVersion", essl300, ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{ESSLVersion: 300, ForceVersion: 300}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader, err := st.TranslateShaderWithOptions(tt.src, "vertex", tt.spec, tt.output, tt.opts)
+			if tt.wantErr {
+				if !errors.Is(err, ErrValidation) {
+					t.Errorf("err = %v, want ErrValidation", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(shader.Code, tt.want) || strings.Count(shader.Code, "#version") != 1 {
+				t.Errorf("Code:\n%s\nwant it to start with %q", shader.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarnNonUniformSampling(t *testing.T) {
+	st := newTestTranslator(t)
+	tests := []struct {
+		name      string
+		body      string
+		wantLines []int
+	}{
+		{"top level", "    color = texture(tex, uv);\n", nil},
+		{"non-uniform if", "    if (uv.x > 0.5) {\n        color = texture(tex, uv);\n    }\n", []int{10}},
+		{"uniform if", "    if (gain > 0.5) {\n        color = texture(tex, uv);\n    }\n", nil},
+		{"explicit LOD", "    if (uv.x > 0.5) {\n        color = textureLod(tex, uv, 0.0);\n    }\n", nil},
+		{"uniform loop", "    for (int i = 0; i < 4; i++) {\n        color += texture(tex, uv);\n    }\n", nil},
+		{"non-uniform loop", "    for (int i = 0; float(i) < uv.x; i++) {\n        color += texture(tex, uv);\n    }\n", []int{10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := "#version 300 es\nprecision mediump float;\nuniform sampler2D tex;\nuniform float gain;\nin vec2 uv;\nout vec4 color;\nvoid main() {\n    color = vec4(0.0);\n" + tt.body + "}\n"
+			for _, warn := range []bool{false, true} {
+				shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{WarnNonUniformSampling: warn})
+				var lines []int
+				for _, d := range shader.Diagnostics {
+					if d.Token == "texture" {
+						lines = append(lines, d.Line)
+					}
+				}
+				want := tt.wantLines
+				if !warn {
+					want = nil
+				}
+				if !slices.Equal(lines, want) {
+					t.Errorf("WarnNonUniformSampling %v: warnings on lines %v, want %v", warn, lines, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewShaderTranslatorFromCompiled(t *testing.T) {
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+	cm, err := r.CompileModule(ctx, EmbeddedModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := "#version 300 es\nin vec4 pos;\nvoid main() {\n    gl_Position = pos;\n}\n"
+
+	// two translators share the runtime under different module names
+	first, err := NewShaderTranslatorFromCompiled(ctx, r, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewShaderTranslatorFromCompiled(ctx, r, cm, WithModuleName("angle-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range []*ShaderTranslator{first, second} {
+		if _, err := st.TranslateShader(src, "vertex", ShaderSpecGLES3, OutputFormatGLSL330); err != nil {
+			t.Errorf("%s: %v", st.module.Name(), err)
+		}
+	}
+	// closing one leaves the runtime, and the other translator, usable
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Module("angle") != nil {
+		t.Error("Close left the module instantiated")
+	}
+	if _, err := second.TranslateShader(src, "vertex", ShaderSpecGLES3, OutputFormatGLSL330); err != nil {
+		t.Errorf("after closing the other translator: %v", err)
+	}
+	if err := second.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a module without the translator's exports is rejected
+	empty, err := r.CompileModule(ctx, []byte("\x00asm\x01\x00\x00\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewShaderTranslatorFromCompiled(ctx, r, empty); !errors.Is(err, ErrRuntime) || !strings.Contains(err.Error(), `does not export "initialize"`) {
+		t.Errorf("err = %v, want ErrRuntime for the missing export", err)
+	}
+}
+
+func TestRequiredExtensions(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"none", "void main() {}\n", nil},
+		{"two required, one disabled", "#version 310 es\n#extension GL_EXT_geometry_shader : require\n#extension GL_OES_sample_variables : disable\n  #  extension   GL_EXT_gpu_shader5 :   require\nvoid main() {}\n",
+			[]string{"GL_EXT_geometry_shader", "GL_EXT_gpu_shader5"}},
+		{"enable and warn", "#extension GL_OES_standard_derivatives : enable\n#extension GL_EXT_frag_depth : warn\n", nil},
+		{"later directive wins", "#extension GL_EXT_frag_depth : require\n#extension GL_EXT_frag_depth : disable\n#extension GL_OES_texture_3D : enable\n#extension GL_OES_texture_3D : require\n",
+			[]string{"GL_OES_texture_3D"}},
+		{"comments", "// #extension GL_EXT_frag_depth : require\n/* #extension GL_EXT_gpu_shader5 : require */\n#extension GL_EXT_shader_io_blocks : require // needed\n",
+			[]string{"GL_EXT_shader_io_blocks"}},
+		{"crlf", "#extension GL_EXT_frag_depth : require\r\n#extension GL_EXT_gpu_shader5 : require\r\n", []string{"GL_EXT_frag_depth", "GL_EXT_gpu_shader5"}},
+		{"not a directive", "#extensions GL_EXT_frag_depth : require\n#extension GL_EXT_gpu_shader5\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RequiredExtensions(tt.src); !slices.Equal(got, tt.want) {
+				t.Errorf("RequiredExtensions() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig(t *testing.T) {
+	observer := func(string, time.Duration) {}
+	tests := []struct {
+		name         string
+		opts         []TranslatorOption
+		want         TranslatorConfig
+		wantObserver bool
+	}{
+		{"defaults", nil, TranslatorConfig{MaxResponseSize: 4 << 20, ModuleName: "angle", Engine: EngineAuto}, false},
+		{"options", []TranslatorOption{WithMaxResponseSize(1 << 16), WithModuleName("named"), WithInterpreter(), WithObserver(observer)},
+			TranslatorConfig{MaxResponseSize: 1 << 16, ModuleName: "named", Engine: EngineInterpreter}, true},
+		{"later option wins", []TranslatorOption{WithInterpreter(), WithCompiler()},
+			TranslatorConfig{MaxResponseSize: 4 << 20, ModuleName: "angle", Engine: EngineCompiler}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newTestTranslator(t, tt.opts...)
+			got := st.Config()
+			if (got.Observer != nil) != tt.wantObserver {
+				t.Errorf("Observer set: %v, want %v", got.Observer != nil, tt.wantObserver)
+			}
+			got.Observer = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Config() = %+v, want %+v", got, tt.want)
+			}
+
+			// the copy does not reach the translator
+			got.MaxResponseSize = 1
+			got.ModuleName = "changed"
+			if c := st.Config(); c.MaxResponseSize != tt.want.MaxResponseSize || c.ModuleName != tt.want.ModuleName {
+				t.Errorf("Config() changed to %+v", c)
+			}
+		})
+	}
+}
+
+func TestTranslateStream(t *testing.T) {
+	t.Run("drain", func(t *testing.T) {
+		in := make(chan TranslateRequest)
+		out := TranslateStream(context.Background(), in, 3)
+		want := make(map[string]bool)
+		go func() {
+			defer close(in)
+			for i := 0; i < 12; i++ {
+				src := fmt.Sprintf("#version 300 es\nvoid main() {\n    gl_Position = vec4(%d.0);\n}\n", i)
+				if i == 5 {
+					src = "#version 300 es\nvoid main() {\n    gl_Position = undeclared;\n}\n"
+				}
+				want[src] = i != 5
+				in <- TranslateRequest{Source: src, ShaderType: "vertex", Spec: ShaderSpecGLES3, Output: OutputFormatGLSL330}
+			}
+		}()
+		got := make(map[string]bool)
+		for result := range out {
+			if (result.Err == nil) != (result.Shader != nil) {
+				t.Errorf("result has Shader %v and Err %v", result.Shader != nil, result.Err)
+			}
+			got[result.Request.Source] = result.Err == nil
+		}
+		// results come in any order, one per request
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("results = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		in := make(chan TranslateRequest)
+		out := TranslateStream(ctx, in, 2)
+		in <- TranslateRequest{Source: "void main() {}\n", ShaderType: "vertex", Spec: ShaderSpecGLES2, Output: OutputFormatESSL}
+		if result := <-out; result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		// in stays open; cancelling alone must end the stream
+		cancel()
+		select {
+		case _, ok := <-out:
+			if ok {
+				t.Error("result after cancel")
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("output channel not closed after cancel")
+		}
+	})
+}
+
+func TestFragmentOutputMapping(t *testing.T) {
+	st := newTestTranslator(t)
+	tests := []struct {
+		name string
+		spec ShaderSpec
+		src  string
+		want map[string]int
+	}{
+		{"two outputs", ShaderSpecGLES3, "#version 300 es\nprecision mediump float;\nlayout(location = 0) out vec4 albedo;\nlayout(location = 1) out vec4 normal;\nvoid main() {\n    albedo = vec4(1.0);\n    normal = vec4(0.0);\n}\n",
+			map[string]int{"albedo": 0, "normal": 1}},
+		{"single output", ShaderSpecGLES3, "#version 300 es\nprecision mediump float;\nout vec4 color;\nvoid main() {\n    color = vec4(1.0);\n}\n",
+			map[string]int{"color": 0}},
+		{"array and depth", ShaderSpecGLES3, "#version 300 es\nprecision mediump float;\nlayout(location = 1) out vec4 targets[2];\nvoid main() {\n    targets[0] = vec4(1.0);\n    targets[1] = vec4(0.0);\n    gl_FragDepth = 0.5;\n}\n",
+			map[string]int{"targets": 1}},
+		{"gl_FragColor", ShaderSpecGLES2, "precision mediump float;\nvoid main() {\n    gl_FragColor = vec4(1.0);\n}\n",
+			map[string]int{"gl_FragColor": 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader := mustTranslate(t, st, tt.src, "fragment", tt.spec, OutputFormatGLSL330, TranslateOptions{})
+			if got := shader.FragmentOutputMapping(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FragmentOutputMapping() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	vertex := mustTranslate(t, st, "void main() {\n    gl_Position = vec4(0.0);\n}\n", "vertex", ShaderSpecGLES2, OutputFormatGLSL330, TranslateOptions{})
+	if got := vertex.FragmentOutputMapping(); len(got) != 0 {
+		t.Errorf("vertex shader FragmentOutputMapping() = %v, want empty", got)
+	}
+}
+
+func TestOutputVersion(t *testing.T) {
+	st := newTestTranslator(t)
+	essl300 := "#version 300 es\nvoid main() {\n    gl_Position = vec4(0.0);\n}\n"
+	essl100 := "void main() {\n    gl_Position = vec4(0.0);\n}\n"
+	tests := []struct {
+		name        string
+		src         string
+		spec        ShaderSpec
+		output      OutputFormat
+		opts        TranslateOptions
+		wantVersion int
+		wantES      bool
+		wantProfile string
+	}{
+		{"glsl330", essl300, ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{}, 330, false, ""},
+		{"glsl330 core", essl300, ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{Profile: GLSLProfileCore}, 330, false, "core"},
+		{"glsl450 compatibility", essl300, ShaderSpecGLES3, OutputFormatGLSL450, TranslateOptions{Profile: GLSLProfileCompatibility}, 450, false, "compatibility"},
+		{"essl300", essl300, ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{}, 300, true, ""},
+		// ANGLE emits no directive for ESSL 1.00
+		{"essl100", essl100, ShaderSpecGLES2, OutputFormatESSL, TranslateOptions{}, 0, false, ""},
+		{"essl100 pinned", essl100, ShaderSpecGLES2, OutputFormatESSL, TranslateOptions{ESSLVersion: 100}, 100, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader := mustTranslate(t, st, tt.src, "vertex", tt.spec, tt.output, tt.opts)
+			version, es, profile := shader.OutputVersion()
+			if version != tt.wantVersion || es != tt.wantES || profile != tt.wantProfile {
+				t.Errorf("OutputVersion() = %d, %v, %q, want %d, %v, %q", version, es, profile, tt.wantVersion, tt.wantES, tt.wantProfile)
+			}
+		})
+	}
+}
+
+func TestEstimatedTempRegisters(t *testing.T) {
+	st := newTestTranslator(t)
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"no locals", "void main() {\n    color = u;\n}\n", 0},
+		{"one vector", "void main() {\n    vec4 a = u * 2.0;\n    color = a;\n}\n", 1},
+		{"matrix and vector", "void main() {\n    mat4 m = mat4(u, u, u, u);\n    vec4 a = m * u;\n    color = a;\n}\n", 5},
+		// the register of a block's local is reused by the next block
+		{"sibling blocks", "void main() {\n    color = vec4(0.0);\n    {\n        vec4 a = u * 2.0;\n        color += a;\n    }\n    {\n        vec4 b = u * 3.0;\n        color += b;\n    }\n}\n", 1},
+		{"parameters", "vec4 f(vec4 x, vec4 y, float z) {\n    vec4 t = x * y;\n    return t * z;\n}\nvoid main() {\n    color = f(u, u, 1.0);\n}\n", 4},
+		{"constants", "void main() {\n    const float k = 2.0;\n    float s = u.x * k;\n    color = vec4(s);\n}\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := "#version 300 es\nprecision mediump float;\nuniform vec4 u;\nout vec4 color;\n" + tt.body
+			shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{})
+			if got := shader.EstimatedTempRegisters(); got != tt.want {
+				t.Errorf("EstimatedTempRegisters() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamePrefix(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 300 es
+precision mediump float;
+uniform vec4 tint;
+layout(std140) uniform Params { vec4 gain; } params;
+in vec2 uv;
+out vec4 color;
+void main() {
+    color = tint * params.gain * uv.x;
+}
+`
+	tests := []struct {
+		name    string
+		opts    TranslateOptions
+		prefix  string
+		wantErr bool
+	}{
+		{"default", TranslateOptions{}, "_u", false},
+		{"custom", TranslateOptions{NamePrefix: "my_"}, "my_", false},
+		{"single letter", TranslateOptions{NamePrefix: "x"}, "x", false},
+		{"digit first", TranslateOptions{NamePrefix: "1a"}, "", true},
+		{"gl_", TranslateOptions{NamePrefix: "gl_"}, "", true},
+		{"double underscore", TranslateOptions{NamePrefix: "a__"}, "", true},
+		{"with DisableNameMapping", TranslateOptions{NamePrefix: "my_", DisableNameMapping: true}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader, err := st.TranslateShaderWithOptions(src, "fragment", ShaderSpecGLES3, OutputFormatGLSL330, tt.opts)
+			if tt.wantErr {
+				if !errors.Is(err, ErrValidation) {
+					t.Errorf("err = %v, want ErrValidation", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"tint", "uv", "color"} {
+				if got := shader.Variables[name].MappedName; got != tt.prefix+name {
+					t.Errorf("MappedName of %s = %q, want %q", name, got, tt.prefix+name)
+				}
+			}
+			block := blockByName(t, shader, "Params")
+			if block.MappedName != tt.prefix+"Params" || block.Fields[0].MappedName != tt.prefix+"gain" {
+				t.Errorf("block mapped as %q with member %q", block.MappedName, block.Fields[0].MappedName)
+			}
+			for _, want := range []string{"uniform vec4 " + tt.prefix + "tint;", "uniform " + tt.prefix + "Params{", "main()"} {
+				if !strings.Contains(shader.Code, want) {
+					t.Errorf("Code lacks %q:\n%s", want, shader.Code)
+				}
+			}
+			if tt.prefix != "_u" && regexp.MustCompile(`\b_u\w`).MatchString(shader.Code) {
+				t.Errorf("Code keeps the _u prefix:\n%s", shader.Code)
+			}
+		})
+	}
+}
+
+func TestTranslateProgramSharesOptions(t *testing.T) {
+	st := newTestTranslator(t)
+	stages := map[ShaderType]string{
+		ShaderTypeVertex:   "#version 300 es\nlayout(location = 0) in vec4 pos;\nlayout(location = 1) in vec4 extra;\nout vec4 v;\nvoid main() {\n    v = extra * SCALE;\n    gl_Position = pos;\n}\n",
+		ShaderTypeFragment: "#version 300 es\nprecision mediump float;\nin vec4 v;\nout vec4 color;\nvoid main() {\n    color = v * SCALE;\n}\n",
+	}
+	opts := TranslateOptions{
+		Defines:    map[string]string{"SCALE": "0.5"},
+		Extensions: map[string]ExtensionBehavior{"GL_EXT_gpu_shader5": ExtensionEnable},
+		Resources:  &Resources{MaxVertexAttribs: 2},
+	}
+	shaders, err := st.TranslateProgram(stages, ShaderSpecGLES3, OutputFormatGLSL330, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for stage, shader := range shaders {
+		// the defines and the extension directive reach every stage
+		if !strings.Contains(shader.Code, "0.5") {
+			t.Errorf("%s: SCALE not defined:\n%s", stage, shader.Code)
+		}
+		if !strings.Contains(shader.Warnings, "'GL_EXT_gpu_shader5' : extension is not supported") {
+			t.Errorf("%s: Warnings = %q, want the extension warning", stage, shader.Warnings)
+		}
+	}
+	if problems := CheckPipeline(shaders); problems != nil {
+		t.Errorf("CheckPipeline() = %q", problems)
+	}
+
+	// one limit set for the program is enforced on the stage it affects
+	opts.Resources = &Resources{MaxVertexAttribs: 1}
+	if _, err := st.TranslateProgram(stages, ShaderSpecGLES3, OutputFormatGLSL330, opts); err == nil || !strings.HasPrefix(err.Error(), "vertex: ") {
+		t.Errorf("MaxVertexAttribs 1: err = %v, want a vertex stage failure", err)
+	}
+	opts.Resources = nil
+	opts.Extensions = map[string]ExtensionBehavior{"GL_EXT_gpu_shader5": ExtensionRequire}
+	if _, err := st.TranslateProgram(stages, ShaderSpecGLES3, OutputFormatGLSL330, opts); !errors.Is(err, ErrCompile) {
+		t.Errorf("required extension: err = %v, want ErrCompile", err)
+	}
+
+	stages["pixel"] = stages[ShaderTypeFragment]
+	if _, err := st.TranslateProgram(stages, ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{Defines: opts.Defines}); !errors.Is(err, ErrValidation) {
+		t.Errorf("unknown stage: err = %v, want ErrValidation", err)
+	}
+}
+
+func TestActiveUniforms(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 300 es
+precision mediump float;
+uniform vec4 zeta;
+uniform vec4 unusedA;
+uniform sampler2D tex;
+uniform float alpha;
+uniform mat4 unusedB;
+layout(std140) uniform Block { vec4 inBlock; };
+in vec2 uv;
+out vec4 color;
+void main() {
+    color = zeta * texture(tex, uv) * alpha + inBlock;
+}
+`
+	var first []string
+	for i := 0; i < 5; i++ {
+		shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{})
+		var got []string
+		for _, v := range shader.ActiveUniforms() {
+			got = append(got, v.Name)
+		}
+		if first == nil {
+			first = got
+			sorted := slices.Sorted(slices.Values(got))
+			if want := []string{"alpha", "tex", "zeta"}; !slices.Equal(sorted, want) {
+				t.Fatalf("ActiveUniforms() = %q, want %q in any order", got, want)
+			}
+		}
+		// the order is the module's, but the same every time
+		if !slices.Equal(got, first) {
+			t.Fatalf("run %d: ActiveUniforms() = %q, want %q", i, got, first)
+		}
+	}
+}
+
+func TestCategories(t *testing.T) {
+	st := newTestTranslator(t)
+	tests := []struct {
+		name, shaderType, src string
+		want                  []string
+	}{
+		{"vertex", "vertex", "#version 300 es\nin vec4 pos;\nuniform vec4 offset;\nout vec4 v;\nvoid main() {\n    v = offset;\n    gl_Position = pos;\n}\n",
+			[]string{"attributes", "output_varyings", "uniforms"}},
+		{"fragment", "fragment", "#version 300 es\nprecision mediump float;\nin vec4 v;\nlayout(std140) uniform B { vec4 b; };\nout vec4 color;\nvoid main() {\n    color = v + b;\n}\n",
+			[]string{"input_varyings", "output_variables", "uniform_blocks"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader := mustTranslate(t, st, tt.src, tt.shaderType, ShaderSpecGLES3, OutputFormatGLSL330, TranslateOptions{})
+			if got := shader.Categories(); !slices.Equal(got, tt.want) {
+				t.Errorf("Categories() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderComment(t *testing.T) {
+	st := newTestTranslator(t)
+	header := "source: water.frag\r\ntranslator: goshadertranslator\n\noptions: default"
+	wantHeader := "// source: water.frag\n// translator: goshadertranslator\n//\n// options: default\n"
+	tests := []struct {
+		name, src string
+		spec      ShaderSpec
+		output    OutputFormat
+		prefix    string
+	}{
+		{"essl 300", "#version 300 es\nprecision mediump float;\nout vec4 color;\nvoid main() {\n    color = vec4(1.0);\n}\n", ShaderSpecGLES3, OutputFormatESSL, "#version 300 es\n"},
+		{"glsl 330", "#version 300 es\nprecision mediump float;\nout vec4 color;\nvoid main() {\n    color = vec4(1.0);\n}\n", ShaderSpecGLES3, OutputFormatGLSL330, "#version 330\n"},
+		// without a directive the header goes first
+		{"essl 100", "precision mediump float;\nvoid main() {\n    gl_FragColor = vec4(1.0);\n}\n", ShaderSpecGLES2, OutputFormatESSL, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader := mustTranslate(t, st, tt.src, "fragment", tt.spec, tt.output, TranslateOptions{HeaderComment: header})
+			if !strings.HasPrefix(shader.Code, tt.prefix+wantHeader) {
+				t.Errorf("Code:\n%s\nwant it to start with:\n%s", shader.Code, tt.prefix+wantHeader)
+			}
+			plain := mustTranslate(t, st, tt.src, "fragment", tt.spec, tt.output, TranslateOptions{})
+			if strings.Replace(shader.Code, wantHeader, "", 1) != plain.Code {
+				t.Errorf("header changed the rest of Code:\n%s", shader.Code)
+			}
+			// ESSL output is valid input, so it must still compile
+			if tt.output == OutputFormatESSL {
+				mustTranslate(t, st, shader.Code, "fragment", tt.spec, OutputFormatESSL, TranslateOptions{})
+			}
+		})
+	}
+}
+
+func TestSortReflection(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 300 es
+layout(location = 0) in vec3 zeta;
+layout(location = 1) in vec2 alpha;
+layout(location = 2) in vec4 mid;
+uniform mat4 wvp;
+uniform vec4 bias;
+out vec2 v_uv;
+out vec4 a_color;
+void main() {
+    v_uv = alpha;
+    a_color = mid + bias;
+    gl_Position = wvp * vec4(zeta, 1.0);
+}
+`
+	names := func(vars []ShaderVariable) []string {
+		var out []string
+		for _, v := range vars {
+			out = append(out, v.Name)
+		}
+		return out
+	}
+	tests := []struct {
+		name      string
+		sort      bool
+		wantAttrs []string
+	}{
+		{"declaration order", false, []string{"zeta", "alpha", "mid"}},
+		{"sorted", true, []string{"alpha", "mid", "zeta"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := TranslateOptions{SortReflection: tt.sort}
+			r := mustTranslate(t, st, src, "vertex", ShaderSpecGLES3, OutputFormatESSL, opts).Reflect()
+			if got := names(r.Attributes); !slices.Equal(got, tt.wantAttrs) {
+				t.Errorf("Attributes = %v, want %v", got, tt.wantAttrs)
+			}
+			for kind, vars := range map[string][]ShaderVariable{"Uniforms": r.Uniforms, "OutputVaryings": r.OutputVaryings} {
+				if got := names(vars); !slices.IsSorted(got) {
+					t.Errorf("%s = %v, want them sorted", kind, got)
+				}
+			}
+			for i := 0; i < 3; i++ {
+				again := mustTranslate(t, st, src, "vertex", ShaderSpecGLES3, OutputFormatESSL, opts).Reflect()
+				if !reflect.DeepEqual(again, r) {
+					t.Fatalf("run %d Reflect() = %+v, want %+v", i, again, r)
+				}
+			}
+		})
+	}
+}
+
+func TestSkipObjectCode(t *testing.T) {
+	st := newTestTranslator(t)
+	src := `#version 300 es
+precision mediump float;
+uniform sampler2D tex;
+in vec2 v_uv;
+out vec4 color;
+void main() {
+    color = texture(tex, v_uv) * dFdx(v_uv.x);
+}
+`
+	tests := []struct {
+		name string
+		opts TranslateOptions
+	}{
+		{"plain", TranslateOptions{SkipObjectCode: true}},
+		{"with header comment", TranslateOptions{SkipObjectCode: true, HeaderComment: "ignored"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shader := mustTranslate(t, st, src, "fragment", ShaderSpecGLES3, OutputFormatESSL, tt.opts)
+			if shader.Code != "" {
+				t.Errorf("Code = %q, want it empty", shader.Code)
+			}
+			for _, name := range []string{"tex", "v_uv", "color"} {
+				if _, ok := shader.Variables[name]; !ok {
+					t.Errorf("Variables is missing %q: %v", name, shader.Variables)
+				}
+			}
+			if shader.UsesDerivatives {
+				t.Error("UsesDerivatives = true, want false without Code")
+			}
+		})
+	}
+
+	t.Run("compile error", func(t *testing.T) {
+		_, err := st.TranslateShaderWithOptions("#version 300 es\nvoid main() { undefined(); }\n", "fragment", ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{SkipObjectCode: true})
+		if !errors.Is(err, ErrCompile) {
+			t.Errorf("err = %v, want ErrCompile", err)
+		}
+	})
+	t.Run("AssignBlockBindings", func(t *testing.T) {
+		_, err := st.TranslateShaderWithOptions(src, "fragment", ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{SkipObjectCode: true, AssignBlockBindings: true})
+		if !errors.Is(err, ErrValidation) {
+			t.Errorf("err = %v, want ErrValidation", err)
+		}
+	})
+}
+
+func TestCodeHash(t *testing.T) {
+	st := newTestTranslator(t)
+	red := "#version 300 es\nprecision mediump float;\nout vec4 color;\nvoid main() {\n    color = vec4(1.0, 0.0, 0.0, 1.0);\n}\n"
+	blue := strings.Replace(red, "1.0, 0.0, 0.0", "0.0, 0.0, 1.0", 1)
+	hashes := make(map[string]string)
+	for _, tt := range []struct{ name, src string }{{"red", red}, {"blue", blue}} {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := mustTranslate(t, st, tt.src, "fragment", ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{}).CodeHash()
+			if !regexp.MustCompile(`^[0-9a-f]{64}$`).MatchString(hash) {
+				t.Fatalf("CodeHash() = %q, want 64 lowercase hex digits", hash)
+			}
+			for i := 0; i < 3; i++ {
+				if again := mustTranslate(t, st, tt.src, "fragment", ShaderSpecGLES3, OutputFormatESSL, TranslateOptions{}).CodeHash(); again != hash {
+					t.Fatalf("run %d CodeHash() = %s, want %s", i, again, hash)
+				}
+			}
+			hashes[tt.name] = hash
+		})
+	}
+	if hashes["red"] == hashes["blue"] {
+		t.Errorf("different code gave the same hash %s", hashes["red"])
+	}
+}